@@ -3,7 +3,6 @@ package conditions
 import (
 	"fmt"
 	"regexp"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -18,6 +17,9 @@ const (
 	String   = DataType("string")
 	Time     = DataType("time")
 	Duration = DataType("duration")
+
+	SliceString = DataType("[]string")
+	SliceNumber = DataType("[]number")
 )
 
 // InspectDataType returns the data type of a given value.
@@ -33,6 +35,10 @@ func InspectDataType(v interface{}) DataType {
 		return Time
 	case time.Duration:
 		return Duration
+	case []string:
+		return SliceString
+	case []float64:
+		return SliceNumber
 	default:
 		return Unknown
 	}
@@ -47,13 +53,18 @@ type Node interface {
 func (_ *VarRef) node()             {}
 func (_ *NumberLiteral) node()      {}
 func (_ *StringLiteral) node()      {}
+func (_ *RegexLiteral) node()       {}
 func (_ *BooleanLiteral) node()     {}
+func (_ *nullLiteral) node()        {}
 func (_ *TimeLiteral) node()        {}
 func (_ *DurationLiteral) node()    {}
 func (_ *BinaryExpr) node()         {}
+func (_ *UnaryExpr) node()          {}
+func (_ *CallExpr) node()           {}
 func (_ *ParenExpr) node()          {}
 func (_ *SliceStringLiteral) node() {}
 func (_ *SliceNumberLiteral) node() {}
+func (_ *BadExpr) node()            {}
 
 // Expr represents an expression that can be evaluated to a value.
 type Expr interface {
@@ -65,21 +76,30 @@ type Expr interface {
 func (_ *VarRef) expr()             {}
 func (_ *NumberLiteral) expr()      {}
 func (_ *StringLiteral) expr()      {}
+func (_ *RegexLiteral) expr()       {}
 func (_ *BooleanLiteral) expr()     {}
+func (_ *nullLiteral) expr()        {}
 func (_ *TimeLiteral) expr()        {}
 func (_ *DurationLiteral) expr()    {}
 func (_ *BinaryExpr) expr()         {}
+func (_ *UnaryExpr) expr()          {}
+func (_ *CallExpr) expr()           {}
 func (_ *ParenExpr) expr()          {}
 func (_ *SliceStringLiteral) expr() {}
 func (_ *SliceNumberLiteral) expr() {}
+func (_ *BadExpr) expr()            {}
 
 // VarRef represents a reference to a variable.
 type VarRef struct {
+	// Val is the flat name of the variable, [foo][bar] is "foo.bar"
 	Val string
+	// Path holds the segments of a nested reference, [foo][bar] is
+	// ["foo", "bar"]
+	Path []string
 }
 
 // String returns a string representation of the variable reference.
-func (r *VarRef) String() string { return QuoteIdent(r.Val) }
+func (r *VarRef) String() string { return Format(r) }
 
 func (r *VarRef) Args() []string {
 	return []string{r.Val}
@@ -91,7 +111,7 @@ type NumberLiteral struct {
 }
 
 // String returns a string representation of the literal.
-func (l *NumberLiteral) String() string { return strconv.FormatFloat(l.Val, 'f', 3, 64) }
+func (l *NumberLiteral) String() string { return Format(l) }
 
 func (n *NumberLiteral) Args() []string {
 	args := []string{}
@@ -103,9 +123,7 @@ type SliceStringLiteral struct {
 }
 
 // String returns a string representation of the literal.
-func (l *SliceStringLiteral) String() string {
-	return fmt.Sprintf("%s", l.Val)
-}
+func (l *SliceStringLiteral) String() string { return Format(l) }
 
 func (l *SliceStringLiteral) Args() []string {
 	args := []string{}
@@ -117,9 +135,7 @@ type SliceNumberLiteral struct {
 }
 
 // String returns a string representation of the literal.
-func (l *SliceNumberLiteral) String() string {
-	return fmt.Sprintf("%s", l.Val)
-}
+func (l *SliceNumberLiteral) String() string { return Format(l) }
 
 func (l *SliceNumberLiteral) Args() []string {
 	args := []string{}
@@ -132,46 +148,82 @@ type BooleanLiteral struct {
 }
 
 // String returns a string representation of the literal.
-func (l *BooleanLiteral) String() string {
-	if l.Val {
-		return "true"
-	}
-	return "false"
-}
+func (l *BooleanLiteral) String() string { return Format(l) }
 
 func (l *BooleanLiteral) Args() []string {
 	args := []string{}
 	return args
 }
 
+// nullLiteral represents the value of a missing variable evaluated with
+// MissingNull or MissingFalse. It only exists while evaluating and has no
+// source form.
+type nullLiteral struct{}
+
+// String returns a string representation of the literal.
+func (l *nullLiteral) String() string { return Format(l) }
+
+func (l *nullLiteral) Args() []string {
+	args := []string{}
+	return args
+}
+
 // StringLiteral represents a string literal.
 type StringLiteral struct {
 	Val string
 }
 
 // String returns a string representation of the literal.
-func (l *StringLiteral) String() string { return Quote(l.Val) }
+func (l *StringLiteral) String() string { return Format(l) }
+
+func (l *StringLiteral) Args() []string {
+	args := []string{}
+	return args
+}
+
+// RegexLiteral represents a regular expression literal, compiled by the
+// parser.
+type RegexLiteral struct {
+	// Pattern is the source of the pattern, without escapes of the slashes
+	Pattern string
+	// Flags are the i, m and s flags following the closing slash
+	Flags string
+	Val   *regexp.Regexp
+}
+
+// String returns a string representation of the literal.
+func (l *RegexLiteral) String() string { return Format(l) }
+
+func (l *RegexLiteral) Args() []string {
+	args := []string{}
+	return args
+}
 
 // TimeLiteral represents a point-in-time literal.
 type TimeLiteral struct {
 	Val time.Time
 }
 
-func (l *StringLiteral) Args() []string {
+// String returns a string representation of the literal.
+func (l *TimeLiteral) String() string { return Format(l) }
+
+func (l *TimeLiteral) Args() []string {
 	args := []string{}
 	return args
 }
 
-// String returns a string representation of the literal.
-func (l *TimeLiteral) String() string { return l.Val.UTC().Format("2006-01-02 15:04:05.999") }
-
 // DurationLiteral represents a duration literal.
 type DurationLiteral struct {
 	Val time.Duration
 }
 
 // String returns a string representation of the literal.
-func (l *DurationLiteral) String() string { return FormatDuration(l.Val) }
+func (l *DurationLiteral) String() string { return Format(l) }
+
+func (l *DurationLiteral) Args() []string {
+	args := []string{}
+	return args
+}
 
 // BinaryExpr represents an operation between two expressions.
 type BinaryExpr struct {
@@ -181,9 +233,7 @@ type BinaryExpr struct {
 }
 
 // String returns a string representation of the binary expression.
-func (e *BinaryExpr) String() string {
-	return fmt.Sprintf("%s %s %s", e.LHS.String(), e.Op, e.RHS.String())
-}
+func (e *BinaryExpr) String() string { return Format(e) }
 
 func (e *BinaryExpr) Args() []string {
 	args := []string{}
@@ -194,13 +244,45 @@ func (e *BinaryExpr) Args() []string {
 	return args
 }
 
+// UnaryExpr represents an operation applied to a single expression.
+type UnaryExpr struct {
+	Op   Token
+	Expr Expr
+}
+
+// String returns a string representation of the unary expression.
+func (e *UnaryExpr) String() string { return Format(e) }
+
+func (e *UnaryExpr) Args() []string {
+	return e.Expr.Args()
+}
+
+// CallExpr represents a call of a registered function.
+type CallExpr struct {
+	Name      string
+	Arguments []Expr
+	// Func is the function resolved by the parser.
+	Func *Function
+}
+
+// String returns a string representation of the call.
+func (e *CallExpr) String() string { return Format(e) }
+
+func (e *CallExpr) Args() []string {
+	args := []string{}
+	for _, arg := range e.Arguments {
+		args = append(args, arg.Args()...)
+	}
+	return args
+}
+
 // ParenExpr represents a parenthesized expression.
 type ParenExpr struct {
 	Expr Expr
 }
 
 // String returns a string representation of the parenthesized expression.
-func (e *ParenExpr) String() string { return fmt.Sprintf("(%s)", e.Expr.String()) }
+func (e *ParenExpr) String() string { return Format(e) }
 
 func (p *ParenExpr) Args() []string {
 	args := []string{}
@@ -209,6 +291,21 @@ func (p *ParenExpr) Args() []string {
 	return args
 }
 
+// BadExpr is a placeholder for a part of the source which could not be
+// parsed, created by Parser.ParseWithRecovery.
+type BadExpr struct {
+	// Err is the syntax error reported for the node
+	Err *ParseError
+}
+
+// String returns a string representation of the bad expression.
+func (e *BadExpr) String() string { return Format(e) }
+
+func (e *BadExpr) Args() []string {
+	args := []string{}
+	return args
+}
+
 // Visitor can be called by Walk to traverse an AST hierarchy.
 // The Visit() function is called once per node.
 type Visitor interface {
@@ -226,6 +323,14 @@ func Walk(v Visitor, node Node) {
 		Walk(v, n.LHS)
 		Walk(v, n.RHS)
 
+	case *UnaryExpr:
+		Walk(v, n.Expr)
+
+	case *CallExpr:
+		for _, arg := range n.Arguments {
+			Walk(v, arg)
+		}
+
 	case *ParenExpr:
 		Walk(v, n.Expr)
 	}
@@ -268,7 +373,9 @@ func FormatDuration(d time.Duration) string {
 		return fmt.Sprintf("%ds", d/time.Second)
 	} else if d%time.Millisecond == 0 {
 		return fmt.Sprintf("%dms", d/time.Millisecond)
+	} else if d%time.Microsecond == 0 {
+		return fmt.Sprintf("%du", d/time.Microsecond)
 	} else {
-		return fmt.Sprintf("%d", d/time.Microsecond)
+		return fmt.Sprintf("%dns", d)
 	}
 }
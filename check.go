@@ -0,0 +1,192 @@
+package conditions
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TypeError reports an operand type mismatch found by Check.
+type TypeError struct {
+	// Expr is the offending sub-expression
+	Expr Expr
+	Msg  string
+}
+
+// Error returns the string representation of the error.
+func (e *TypeError) Error() string { return fmt.Sprintf("%s: %s", e.Expr, e.Msg) }
+
+// TypeErrors is the list of all type errors found in an expression.
+type TypeErrors []*TypeError
+
+// Error returns the string representation of the errors.
+func (e TypeErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Check infers the type of every node of the expression given the types
+// of the variables and reports every operand mismatch as TypeErrors. The
+// expression must result in a boolean. Variables typed Unknown in the
+// schema accept any value.
+func Check(expr Expr, schema map[string]DataType) error {
+	if expr == nil {
+		return fmt.Errorf("Provided expression is nil")
+	}
+	c := &checker{schema: schema}
+	if t := c.check(expr); t != Boolean && t != Unknown {
+		c.errorf(expr, "expression must be a boolean, got %s", t)
+	}
+	if len(c.errs) > 0 {
+		return c.errs
+	}
+	return nil
+}
+
+// checker collects type errors while inferring types.
+type checker struct {
+	schema map[string]DataType
+	errs   TypeErrors
+}
+
+func (c *checker) errorf(expr Expr, format string, args ...interface{}) {
+	c.errs = append(c.errs, &TypeError{Expr: expr, Msg: fmt.Sprintf(format, args...)})
+}
+
+// check returns the type of expr, Unknown when it cannot be told (an
+// error has already been reported or the value is untyped)
+func (c *checker) check(expr Expr) DataType {
+	switch n := expr.(type) {
+	case *ParenExpr:
+		return c.check(n.Expr)
+	case *VarRef:
+		t, ok := c.schema[n.Val]
+		if !ok {
+			c.errorf(n, "unknown variable")
+		}
+		return t
+	case *UnaryExpr:
+		t := c.check(n.Expr)
+		if isPresence(n.Op) {
+			// Variables of any type can be tested.
+			return Boolean
+		}
+		if t != Boolean && t != Unknown {
+			c.errorf(n, "%s requires a boolean, got %s", n.Op, t)
+		}
+		return Boolean
+	case *CallExpr:
+		return c.checkCall(n)
+	case *BinaryExpr:
+		return c.checkBinary(n)
+	case nil:
+		return Unknown
+	}
+	return staticType(expr)
+}
+
+// checkCall checks the arguments against the function signature
+func (c *checker) checkCall(n *CallExpr) DataType {
+	types := make([]DataType, len(n.Arguments))
+	for i, arg := range n.Arguments {
+		types[i] = c.check(arg)
+	}
+	if n.Func == nil {
+		c.errorf(n, "unknown function %s", n.Name)
+		return Unknown
+	}
+	if len(types) != len(n.Func.Params) {
+		c.errorf(n, "%s expects %d arguments, got %d", n.Name, len(n.Func.Params), len(types))
+		return n.Func.Result
+	}
+	for i, t := range types {
+		want := n.Func.Params[i]
+		if want != Unknown && t != Unknown && want != t {
+			c.errorf(n.Arguments[i], "%s expects %s as argument %d, got %s", n.Name, want, i+1, t)
+		}
+	}
+	return n.Func.Result
+}
+
+// checkBinary checks the operand types against the operator
+func (c *checker) checkBinary(n *BinaryExpr) DataType {
+	l, r := c.check(n.LHS), c.check(n.RHS)
+
+	switch n.Op {
+	case AND, OR, XOR, NAND:
+		if l != Boolean && l != Unknown {
+			c.errorf(n, "%s requires booleans, got %s on the left", n.Op, l)
+		}
+		if r != Boolean && r != Unknown {
+			c.errorf(n, "%s requires booleans, got %s on the right", n.Op, r)
+		}
+		return Boolean
+
+	case EQ, NEQ:
+		if l == Unknown || r == Unknown {
+			return Boolean
+		}
+		switch {
+		case l == SliceString || l == SliceNumber:
+			c.errorf(n, "cannot compare %s", l)
+		case l != r:
+			c.errorf(n, "cannot compare %s with %s", l, r)
+		}
+		return Boolean
+
+	case GT, GTE, LT, LTE:
+		if l == Unknown || r == Unknown {
+			return Boolean
+		}
+		switch {
+		case l != Number && l != Time && l != Duration:
+			c.errorf(n, "%s requires numbers, times or durations, got %s", n.Op, l)
+		case l != r:
+			c.errorf(n, "cannot compare %s with %s", l, r)
+		}
+		return Boolean
+
+	case IN, NOTIN:
+		if l == Unknown || r == Unknown {
+			return Boolean
+		}
+		switch l {
+		case String:
+			if r != SliceString {
+				c.errorf(n, "%s %s requires %s, got %s", l, n.Op, SliceString, r)
+			}
+		case Number:
+			if r != SliceNumber {
+				c.errorf(n, "%s %s requires %s, got %s", l, n.Op, SliceNumber, r)
+			}
+		default:
+			c.errorf(n, "%s requires a string or a number on the left, got %s", n.Op, l)
+		}
+		return Boolean
+
+	case EREG, NEREG:
+		if l != String && l != Unknown {
+			c.errorf(n, "%s requires a string on the left, got %s", n.Op, l)
+		}
+		if r != String && r != Unknown {
+			c.errorf(n, "%s requires a string pattern, got %s", n.Op, r)
+		}
+		return Boolean
+
+	case ADD, SUB, MUL, DIV, MOD:
+		if l == Unknown || r == Unknown {
+			return Unknown
+		}
+		t := arithmeticType(n.Op, l, r)
+		if t == Unknown || (n.Op == MOD && t != Number) {
+			c.errorf(n, "cannot apply %s to %s and %s", n.Op, l, r)
+			return Unknown
+		}
+		return t
+	}
+
+	c.errorf(n, "unsupported operator %s", n.Op)
+	return Unknown
+}
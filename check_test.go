@@ -0,0 +1,88 @@
+package conditions
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testSchema = map[string]DataType{
+	"num":     Number,
+	"str":     String,
+	"flag":    Boolean,
+	"tags":    SliceString,
+	"ids":     SliceNumber,
+	"ts":      Time,
+	"elapsed": Duration,
+	"any":     Unknown,
+	"a.b":     Number,
+}
+
+func TestCheck(t *testing.T) {
+	data := []struct {
+		cond string
+		errs []string
+	}{
+		{`[num] > 5 AND [str] == "x"`, nil},
+		{`[flag] OR NOT [flag]`, nil},
+		{`[str] in [tags] AND [num] not in [ids]`, nil},
+		{`[str] in ["a", "b"] AND [num] in [1, 2]`, nil},
+		{`[str] =~ /^a/ AND [str] !~ /b$/`, nil},
+		{`[num] * 2 + 1 >= [num] % 3`, nil},
+		{`[ts] - [ts] > [elapsed] AND [ts] + 1h > [ts]`, nil},
+		{`[any] > 5 AND [any]`, nil},
+		{`[a][b] < 1`, nil},
+		{`lower([str]) == "admin"`, nil},
+		{`EXISTS [str] AND [num] IS NOT NULL`, nil},
+
+		{`[num] > true`, []string{`[num] > true: cannot compare number with boolean`}},
+		{`[num] == "x"`, []string{`[num] == "x": cannot compare number with string`}},
+		{`[str] in [ids]`, []string{`[str] IN [ids]: string IN requires []string, got []number`}},
+		{`[num] in ["a", "b"]`, []string{`[num] IN ["a", "b"]: number IN requires []number, got []string`}},
+		{`[num] =~ /^a/`, []string{`[num] =~ /^a/: =~ requires a string on the left, got number`}},
+		{`[str] + 1 > 0`, []string{`[str] + 1: cannot apply + to string and number`}},
+		{`[elapsed] % 2 == 1s`, []string{`[elapsed] % 2: cannot apply % to duration and number`}},
+		{`[num] AND [flag]`, []string{`[num] AND [flag]: AND requires booleans, got number on the left`}},
+		{`NOT [str]`, []string{`NOT [str]: NOT requires a boolean, got string`}},
+		{`[num] + 1`, []string{`[num] + 1: expression must be a boolean, got number`}},
+		{`[missing] > 1`, []string{`[missing]: unknown variable`}},
+		{`[missing] IS NULL`, []string{`[missing]: unknown variable`}},
+		{`lower([num]) == "a"`, []string{`[num]: lower expects string as argument 1, got number`}},
+		{
+			`[num] > "a" OR ([str] == true AND [flag] < 1)`,
+			[]string{
+				`[num] > "a": cannot compare number with string`,
+				`[str] == true: cannot compare string with boolean`,
+				`[flag] < 1: < requires numbers, times or durations, got boolean`,
+			},
+		},
+	}
+
+	funcs := NewFunctionRegistry()
+	assert.Nil(t, funcs.Register("lower", strings.ToLower))
+
+	for _, td := range data {
+		p := NewParser(strings.NewReader(td.cond))
+		p.SetFunctions(funcs)
+		expr, err := p.Parse()
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+
+		err = Check(expr, testSchema)
+		if td.errs == nil {
+			assert.Nil(t, err, td.cond)
+			continue
+		}
+		if !assert.NotNil(t, err, td.cond) {
+			continue
+		}
+		errs := err.(TypeErrors)
+		msgs := []string{}
+		for _, e := range errs {
+			msgs = append(msgs, e.Error())
+		}
+		assert.Equal(t, td.errs, msgs, td.cond)
+	}
+}
@@ -0,0 +1,76 @@
+package conditions
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	// ErrBudgetExceeded is returned when an evaluation takes more steps
+	// than Options.MaxSteps.
+	ErrBudgetExceeded = errors.New("Evaluation step budget exceeded")
+	// ErrRegexInputTooLong is returned when a string longer than
+	// Options.MaxRegexInput is matched against a regular expression.
+	ErrRegexInputTooLong = errors.New("Regular expression input too long")
+	// ErrStepsNotSupported is returned by CompileWithOptions when
+	// Options.MaxSteps is set, Programs do not count steps.
+	ErrStepsNotSupported = errors.New("Programs do not support a step budget")
+)
+
+// EvaluateContext evaluates expr like EvaluateWithOptions and checks ctx
+// between the evaluation steps. It returns the error of ctx once it is
+// done, ErrBudgetExceeded and ErrRegexInputTooLong when the limits of opts
+// are exceeded.
+func EvaluateContext(ctx context.Context, expr Expr, args map[string]interface{}, opts Options) (bool, error) {
+	var r resolver = &mapResolver{args: args, mode: opts.Lookup, missing: opts.Missing}
+	if ctx.Done() != nil || opts.MaxSteps > 0 || opts.MaxRegexInput > 0 {
+		r = &limitedResolver{
+			resolver:      r,
+			ctx:           ctx,
+			maxSteps:      opts.MaxSteps,
+			maxRegexInput: opts.MaxRegexInput,
+		}
+	}
+	return evaluate(expr, r)
+}
+
+// limitedResolver enforces the context and the limits of an evaluation.
+type limitedResolver struct {
+	resolver
+	ctx           context.Context
+	steps         int
+	maxSteps      int
+	maxRegexInput int
+}
+
+// step accounts for n evaluation steps.
+func (r *limitedResolver) step(n int) error {
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+	r.steps += n
+	if r.maxSteps > 0 && r.steps > r.maxSteps {
+		return ErrBudgetExceeded
+	}
+	return nil
+}
+
+// checkOperands accounts for the cost of an operator depending on its
+// operands: an IN list takes a step per element, a regular expression
+// input is limited in length.
+func (r *limitedResolver) checkOperands(op Token, l, rv Expr) error {
+	switch op {
+	case IN, NOTIN:
+		switch s := rv.(type) {
+		case *SliceStringLiteral:
+			return r.step(len(s.Val))
+		case *SliceNumberLiteral:
+			return r.step(len(s.Val))
+		}
+	case EREG, NEREG:
+		if s, ok := l.(*StringLiteral); ok && r.maxRegexInput > 0 && len(s.Val) > r.maxRegexInput {
+			return ErrRegexInputTooLong
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package conditions
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvaluateContext(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+
+	args := map[string]interface{}{
+		"a":    1,
+		"s":    strings.Repeat("x", 100),
+		"tags": []string{"a", "b", "c", "d"},
+	}
+	data := []struct {
+		ctx  context.Context
+		cond string
+		opts Options
+		want bool
+		err  error
+	}{
+		{context.Background(), `[a] == 1`, Options{}, true, nil},
+		{cancelled, `[a] == 1`, Options{}, false, context.Canceled},
+		{expired, `[a] == 1`, Options{}, false, context.DeadlineExceeded},
+
+		// [a] == 1 takes 3 steps, each IN list element one more.
+		{context.Background(), `[a] == 1`, Options{MaxSteps: 3}, true, nil},
+		{context.Background(), `[a] == 1`, Options{MaxSteps: 2}, false, ErrBudgetExceeded},
+		{context.Background(), `[a] in [1, 2, 3]`, Options{MaxSteps: 6}, true, nil},
+		{context.Background(), `[a] in [1, 2, 3]`, Options{MaxSteps: 5}, false, ErrBudgetExceeded},
+		{context.Background(), `false AND ([a] > 1 OR [a] < 1)`, Options{MaxSteps: 2}, false, nil},
+
+		{context.Background(), `[s] =~ /^x+$/`, Options{MaxRegexInput: 100}, true, nil},
+		{context.Background(), `[s] =~ /^x+$/`, Options{MaxRegexInput: 99}, false, ErrRegexInputTooLong},
+		{context.Background(), `[s] !~ "y"`, Options{MaxRegexInput: 10}, false, ErrRegexInputTooLong},
+	}
+
+	for _, td := range data {
+		expr, err := NewParser(strings.NewReader(td.cond)).Parse()
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+		got, err := EvaluateContext(td.ctx, expr, args, td.opts)
+		assert.Equal(t, td.err, err, td.cond)
+		assert.Equal(t, td.want, got, td.cond)
+
+		// The options are the same without a context.
+		if td.ctx == context.Background() {
+			got, err = EvaluateWithOptions(expr, args, td.opts)
+			assert.Equal(t, td.err, err, td.cond)
+			assert.Equal(t, td.want, got, td.cond)
+		}
+	}
+}
+
+func TestEvaluateContextCancelledBetweenSteps(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	funcs := NewFunctionRegistry()
+	assert.Nil(t, funcs.Register("cancel", func() bool {
+		cancel()
+		return true
+	}))
+	p := NewParser(strings.NewReader(`cancel() AND [a] == 1`))
+	p.SetFunctions(funcs)
+	expr, err := p.Parse()
+	if assert.Nil(t, err) {
+		_, err = EvaluateContext(ctx, expr, map[string]interface{}{"a": 1}, Options{})
+		assert.Equal(t, context.Canceled, err)
+	}
+}
+
+func TestProgramStepsNotSupported(t *testing.T) {
+	expr, err := NewParser(strings.NewReader(`[a] == 1`)).Parse()
+	assert.Nil(t, err)
+	_, err = CompileWithOptions(expr, Options{MaxSteps: 10})
+	assert.Equal(t, ErrStepsNotSupported, err)
+
+	err = NewRuleSet(Options{MaxSteps: 10}).Add(Rule{Name: "a", Expr: expr})
+	if assert.IsType(t, &RuleError{}, err) {
+		assert.Equal(t, ErrStepsNotSupported, err.(*RuleError).Err)
+	}
+}
+
+func TestProgramRegexInputLimit(t *testing.T) {
+	for _, cond := range []string{`[s] =~ /x/`, `[s] =~ [p]`} {
+		expr, err := NewParser(strings.NewReader(cond)).Parse()
+		assert.Nil(t, err)
+		prg, err := CompileWithOptions(expr, Options{MaxRegexInput: 3})
+		if !assert.Nil(t, err, cond) {
+			continue
+		}
+		r, err := prg.Evaluate(map[string]interface{}{"s": "axc", "p": "x"})
+		assert.Nil(t, err, cond)
+		assert.True(t, r, cond)
+		_, err = prg.Evaluate(map[string]interface{}{"s": "abcx", "p": "x"})
+		assert.Equal(t, ErrRegexInputTooLong, err, cond)
+	}
+}
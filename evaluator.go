@@ -1,34 +1,61 @@
 package conditions
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"reflect"
+	"math"
 	"regexp"
+	"time"
 )
 
 var (
 	falseExpr = &BooleanLiteral{Val: false}
+
+	errSyntax = errors.New("Cannot evaluate an expression with syntax errors")
 )
 
 // Evaluate takes an expr and evaluates it using given args
 func Evaluate(expr Expr, args map[string]interface{}) (bool, error) {
+	return EvaluateWithOptions(expr, args, Options{})
+}
+
+// EvaluateWithOptions takes an expr and evaluates it using given args and
+// evaluation options
+func EvaluateWithOptions(expr Expr, args map[string]interface{}, opts Options) (bool, error) {
+	return EvaluateContext(context.Background(), expr, args, opts)
+}
+
+// evaluate evaluates the root expression which must result in a boolean
+func evaluate(expr Expr, args resolver) (bool, error) {
 	if expr == nil {
 		return false, fmt.Errorf("Provided expression is nil")
 	}
+	if hasBadExpr(expr) {
+		return false, errSyntax
+	}
 
 	result, err := evaluateSubtree(expr, args)
 	if err != nil {
 		return false, err
 	}
+	return rootResult(result)
+}
+
+// rootResult returns the result of the root expression which must be a
+// boolean
+func rootResult(result Expr) (bool, error) {
 	switch n := result.(type) {
 	case *BooleanLiteral:
 		return n.Val, nil
+	case *nullLiteral:
+		return false, nil
 	}
 	return false, fmt.Errorf("Unexpected result of the root expression: %#v", result)
 }
 
 // evaluateSubtree performs given expr evaluation recursively
-func evaluateSubtree(expr Expr, args map[string]interface{}) (Expr, error) {
+func evaluateSubtree(expr Expr, args resolver) (Expr, error) {
 	if expr == nil {
 		return falseExpr, fmt.Errorf("Provided expression is nil")
 	}
@@ -38,57 +65,200 @@ func evaluateSubtree(expr Expr, args map[string]interface{}) (Expr, error) {
 		lv, rv Expr
 	)
 
+	limits, limited := args.(*limitedResolver)
+	if limited {
+		if err = limits.step(1); err != nil {
+			return falseExpr, err
+		}
+	}
+
 	switch n := expr.(type) {
 	case *ParenExpr:
 		return evaluateSubtree(n.Expr, args)
+	case *UnaryExpr:
+		if isPresence(n.Op) {
+			return evaluatePresence(n, args)
+		}
+		lv, err = evaluateSubtree(n.Expr, args)
+		if err != nil {
+			return falseExpr, err
+		}
+		return applyUnaryOperator(n.Op, lv)
 	case *BinaryExpr:
 		lv, err = evaluateSubtree(n.LHS, args)
 		if err != nil {
 			return falseExpr, err
 		}
+		if result, ok := shortCircuit(n.Op, lv); ok {
+			return result, nil
+		}
 		rv, err = evaluateSubtree(n.RHS, args)
 		if err != nil {
 			return falseExpr, err
 		}
+		if limited {
+			if err = limits.checkOperands(n.Op, lv, rv); err != nil {
+				return falseExpr, err
+			}
+		}
+		if isNullLiteral(lv) || isNullLiteral(rv) {
+			return applyNull(n.Op, lv, rv, args.missingMode())
+		}
 		return applyOperator(n.Op, lv, rv)
 	case *VarRef:
-		//index, err := strconv.Atoi(strings.Replace(n.Val, "$", "", -1))
-		index := n.Val
-		if err != nil {
-			return falseExpr, fmt.Errorf("Failed to resolve argument index %s: %s", n.Val, err.Error())
-		}
-		if _, ok := args[index]; !ok {
-			return falseExpr, fmt.Errorf("argument: %v not found", index)
-		}
-
-		kind := reflect.TypeOf(args[index]).Kind()
-		switch kind {
-		case reflect.Int:
-			return &NumberLiteral{Val: float64(args[index].(int))}, nil
-		case reflect.Int32:
-			return &NumberLiteral{Val: float64(args[index].(int32))}, nil
-		case reflect.Int64:
-			return &NumberLiteral{Val: float64(args[index].(int64))}, nil
-		case reflect.Float32:
-			return &NumberLiteral{Val: float64(args[index].(float32))}, nil
-		case reflect.Float64:
-			return &NumberLiteral{Val: float64(args[index].(float64))}, nil
-		case reflect.String:
-			return &StringLiteral{Val: args[index].(string)}, nil
-		case reflect.Bool:
-			return &BooleanLiteral{Val: args[index].(bool)}, nil
-		case reflect.Slice:
-			return &SliceStringLiteral{Val: args[index].([]string)}, nil
-		}
-		return falseExpr, fmt.Errorf("Unsupported argument %s type: %s", n.Val, kind)
+		v, ok := args.resolve(n)
+		if (!ok || v == nil) && args.missingMode() != MissingError {
+			return nullExpr, nil
+		}
+		if !ok {
+			return falseExpr, fmt.Errorf("argument: %v not found", n.Val)
+		}
+		return toLiteral(n.Val, v)
+	case *CallExpr:
+		return evaluateCall(n, args)
+	case *BadExpr:
+		return falseExpr, errSyntax
 	}
 
 	return expr, nil
 }
 
+// hasBadExpr reports whether expr has a node which could not be parsed.
+// Such expressions are rejected as a whole, even when the evaluation would
+// not reach the bad node.
+func hasBadExpr(expr Expr) bool {
+	switch n := expr.(type) {
+	case *BadExpr:
+		return true
+	case *ParenExpr:
+		return hasBadExpr(n.Expr)
+	case *UnaryExpr:
+		return hasBadExpr(n.Expr)
+	case *BinaryExpr:
+		return hasBadExpr(n.LHS) || hasBadExpr(n.RHS)
+	case *CallExpr:
+		for _, arg := range n.Arguments {
+			if hasBadExpr(arg) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// evaluateCall evaluates the arguments and calls the resolved function
+func evaluateCall(n *CallExpr, args resolver) (Expr, error) {
+	if n.Func == nil {
+		return falseExpr, fmt.Errorf("Unknown function %s", n.Name)
+	}
+	values := make([]Expr, len(n.Arguments))
+	for i, arg := range n.Arguments {
+		v, err := evaluateSubtree(arg, args)
+		if err != nil {
+			return falseExpr, err
+		}
+		values[i] = v
+	}
+	return applyCall(n, values)
+}
+
+// applyCall calls the resolved function with the evaluated arguments
+func applyCall(n *CallExpr, values []Expr) (Expr, error) {
+	in := make([]interface{}, len(values))
+	for i, v := range values {
+		in[i] = literalValue(v)
+	}
+	result, err := n.Func.Call(in)
+	if err != nil {
+		return falseExpr, err
+	}
+	return toLiteral(n.Name, result)
+}
+
+// toLiteral converts an argument value to the literal expression
+func toLiteral(name string, v interface{}) (Expr, error) {
+	switch a := v.(type) {
+	case int:
+		return &NumberLiteral{Val: float64(a)}, nil
+	case int32:
+		return &NumberLiteral{Val: float64(a)}, nil
+	case int64:
+		return &NumberLiteral{Val: float64(a)}, nil
+	case float32:
+		return &NumberLiteral{Val: float64(a)}, nil
+	case float64:
+		return &NumberLiteral{Val: a}, nil
+	case string:
+		return &StringLiteral{Val: a}, nil
+	case bool:
+		return &BooleanLiteral{Val: a}, nil
+	case []string:
+		return &SliceStringLiteral{Val: a}, nil
+	case []float64:
+		return &SliceNumberLiteral{Val: a}, nil
+	case []interface{}:
+		s, err := sliceArg(name, a)
+		if err != nil {
+			return falseExpr, err
+		}
+		return toLiteral(name, s)
+	case time.Time:
+		return &TimeLiteral{Val: a}, nil
+	case time.Duration:
+		return &DurationLiteral{Val: a}, nil
+	}
+	return falseExpr, fmt.Errorf("Unsupported argument %s type: %T", name, v)
+}
+
+// literalValue returns the Go value held by a literal expression
+func literalValue(e Expr) interface{} {
+	switch n := e.(type) {
+	case *NumberLiteral:
+		return n.Val
+	case *StringLiteral:
+		return n.Val
+	case *RegexLiteral:
+		return n.Val.String()
+	case *BooleanLiteral:
+		return n.Val
+	case *SliceStringLiteral:
+		return n.Val
+	case *SliceNumberLiteral:
+		return n.Val
+	case *TimeLiteral:
+		return n.Val
+	case *DurationLiteral:
+		return n.Val
+	}
+	return nil
+}
+
+// shortCircuit returns the result of a logical operator when it is
+// already decided by its left operand, so the right one is not evaluated
+func shortCircuit(op Token, l Expr) (*BooleanLiteral, bool) {
+	if isNullLiteral(l) {
+		l = falseExpr
+	}
+	b, ok := l.(*BooleanLiteral)
+	if !ok {
+		return nil, false
+	}
+	switch {
+	case op == AND && !b.Val:
+		return &BooleanLiteral{Val: false}, true
+	case op == OR && b.Val:
+		return &BooleanLiteral{Val: true}, true
+	case op == NAND && !b.Val:
+		return &BooleanLiteral{Val: true}, true
+	}
+	return nil, false
+}
+
 // applyOperator is a dispatcher of the evaluation according to operator
-func applyOperator(op Token, l, r Expr) (*BooleanLiteral, error) {
+func applyOperator(op Token, l, r Expr) (Expr, error) {
 	switch op {
+	case ADD, SUB, MUL, DIV, MOD:
+		return applyArithmetic(op, l, r)
 	case AND:
 		return applyAND(l, r)
 	case OR:
@@ -121,42 +291,122 @@ func applyOperator(op Token, l, r Expr) (*BooleanLiteral, error) {
 	return &BooleanLiteral{Val: false}, fmt.Errorf("Unsupported operator: %s", op)
 }
 
-// applyEREG applies EREG operation to l/r operands
+// applyUnaryOperator is a dispatcher of the evaluation according to
+// unary operator
+func applyUnaryOperator(op Token, v Expr) (Expr, error) {
+	switch op {
+	case NOT:
+		return applyNOT(v)
+	}
+	return falseExpr, fmt.Errorf("Unsupported operator: %s", op)
+}
+
+// applyNOT applies NOT operation to the operand
+func applyNOT(v Expr) (*BooleanLiteral, error) {
+	if isNullLiteral(v) {
+		return &BooleanLiteral{Val: true}, nil
+	}
+	a, err := getBoolean(v)
+	if err != nil {
+		return nil, err
+	}
+	return &BooleanLiteral{Val: !a}, nil
+}
+
+// applyArithmetic applies +, -, *, / and % operations to l/r operands
+func applyArithmetic(op Token, l, r Expr) (Expr, error) {
+	var (
+		a, b float64
+		err  error
+	)
+	if isTemporal(l) || isTemporal(r) {
+		v, err := timeArithmetic(op, literalToValue(l), literalToValue(r))
+		if err != nil {
+			return nil, err
+		}
+		return v.literal(), nil
+	}
+	a, err = getNumber(l)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot apply %s to non-number: %v", op, l)
+	}
+	b, err = getNumber(r)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot apply %s to non-number: %v", op, r)
+	}
+	v, err := arithmetic(op, a, b)
+	if err != nil {
+		return nil, err
+	}
+	return &NumberLiteral{Val: v}, nil
+}
+
+// isTemporal tells whether the literal is a time or a duration
+func isTemporal(e Expr) bool {
+	switch e.(type) {
+	case *TimeLiteral, *DurationLiteral:
+		return true
+	}
+	return false
+}
+
+// arithmetic computes the result of an arithmetic operator
+func arithmetic(op Token, a, b float64) (float64, error) {
+	switch op {
+	case ADD:
+		return a + b, nil
+	case SUB:
+		return a - b, nil
+	case MUL:
+		return a * b, nil
+	case DIV:
+		if b == 0 {
+			return 0, fmt.Errorf("Division by zero")
+		}
+		return a / b, nil
+	case MOD:
+		if b == 0 {
+			return 0, fmt.Errorf("Modulo by zero")
+		}
+		return math.Mod(a, b), nil
+	}
+	return 0, fmt.Errorf("Unsupported operator: %s", op)
+}
+
+// applyNEREG applies NEREG operation to l/r operands
 func applyNEREG(l, r Expr) (*BooleanLiteral, error) {
 	result, err := applyEREG(l, r)
+	if err != nil {
+		return nil, err
+	}
 	result.Val = !result.Val
-	return result, err
+	return result, nil
 }
 
 // applyEREG applies EREG operation to l/r operands
 func applyEREG(l, r Expr) (*BooleanLiteral, error) {
-	var (
-		a     string
-		b     string
-		err   error
-		match bool
-	)
-	a, err = getString(l)
+	a, err := getString(l)
 	if err != nil {
 		return nil, err
 	}
 
-	b, err = getString(r)
+	// Regex literals are compiled by the parser, other patterns go
+	// through the cache.
+	re, err := getRegexp(r)
 	if err != nil {
 		return nil, err
 	}
-	match = false
-	match, err = regexp.MatchString(b, a)
-
-	// pp.Print(a, b, match)
-	return &BooleanLiteral{Val: match}, err
+	return &BooleanLiteral{Val: re.MatchString(a)}, nil
 }
 
 // applyNOTIN applies NOT IN operation to l/r operands
 func applyNOTIN(l, r Expr) (*BooleanLiteral, error) {
 	result, err := applyIN(l, r)
+	if err != nil {
+		return nil, err
+	}
 	result.Val = !result.Val
-	return result, err
+	return result, nil
 }
 
 // applyIN applies IN operation to l/r operands
@@ -288,6 +538,8 @@ func applyEQ(l, r Expr) (*BooleanLiteral, error) {
 		as, bs string
 		an, bn float64
 		ab, bb bool
+		at, bt time.Time
+		ad, bd time.Duration
 		err    error
 	)
 	as, err = getString(l)
@@ -314,6 +566,22 @@ func applyEQ(l, r Expr) (*BooleanLiteral, error) {
 		}
 		return &BooleanLiteral{Val: (ab == bb)}, nil
 	}
+	at, err = getTime(l)
+	if err == nil {
+		bt, err = getTime(r)
+		if err != nil {
+			return falseExpr, fmt.Errorf("Cannot compare time with non-time")
+		}
+		return &BooleanLiteral{Val: (at.Equal(bt))}, nil
+	}
+	ad, err = getDuration(l)
+	if err == nil {
+		bd, err = getDuration(r)
+		if err != nil {
+			return falseExpr, fmt.Errorf("Cannot compare duration with non-duration")
+		}
+		return &BooleanLiteral{Val: (ad == bd)}, nil
+	}
 	return falseExpr, nil
 }
 
@@ -323,6 +591,8 @@ func applyNQ(l, r Expr) (*BooleanLiteral, error) {
 		as, bs string
 		an, bn float64
 		ab, bb bool
+		at, bt time.Time
+		ad, bd time.Duration
 		err    error
 	)
 	as, err = getString(l)
@@ -349,75 +619,64 @@ func applyNQ(l, r Expr) (*BooleanLiteral, error) {
 		}
 		return &BooleanLiteral{Val: (ab != bb)}, nil
 	}
+	at, err = getTime(l)
+	if err == nil {
+		bt, err = getTime(r)
+		if err != nil {
+			return falseExpr, fmt.Errorf("Cannot compare time with non-time")
+		}
+		return &BooleanLiteral{Val: (!at.Equal(bt))}, nil
+	}
+	ad, err = getDuration(l)
+	if err == nil {
+		bd, err = getDuration(r)
+		if err != nil {
+			return falseExpr, fmt.Errorf("Cannot compare duration with non-duration")
+		}
+		return &BooleanLiteral{Val: (ad != bd)}, nil
+	}
 	return falseExpr, nil
 }
 
 // applyGT applies > operation to l/r operands
 func applyGT(l, r Expr) (*BooleanLiteral, error) {
-	var (
-		a, b float64
-		err  error
-	)
-	a, err = getNumber(l)
-	if err != nil {
-		return nil, err
-	}
-	b, err = getNumber(r)
+	c, err := compareLiterals(l, r)
 	if err != nil {
 		return nil, err
 	}
-	return &BooleanLiteral{Val: (a > b)}, nil
+	return &BooleanLiteral{Val: c != unordered && c > 0}, nil
 }
 
 // applyGTE applies >= operation to l/r operands
 func applyGTE(l, r Expr) (*BooleanLiteral, error) {
-	var (
-		a, b float64
-		err  error
-	)
-	a, err = getNumber(l)
-	if err != nil {
-		return nil, err
-	}
-	b, err = getNumber(r)
+	c, err := compareLiterals(l, r)
 	if err != nil {
 		return nil, err
 	}
-	return &BooleanLiteral{Val: (a >= b)}, nil
+	return &BooleanLiteral{Val: c != unordered && c >= 0}, nil
 }
 
 // applyLT applies < operation to l/r operands
 func applyLT(l, r Expr) (*BooleanLiteral, error) {
-	var (
-		a, b float64
-		err  error
-	)
-	a, err = getNumber(l)
-	if err != nil {
-		return nil, err
-	}
-	b, err = getNumber(r)
+	c, err := compareLiterals(l, r)
 	if err != nil {
 		return nil, err
 	}
-	return &BooleanLiteral{Val: (a < b)}, nil
+	return &BooleanLiteral{Val: c != unordered && c < 0}, nil
 }
 
 // applyLTE applies <= operation to l/r operands
 func applyLTE(l, r Expr) (*BooleanLiteral, error) {
-	var (
-		a, b float64
-		err  error
-	)
-	a, err = getNumber(l)
-	if err != nil {
-		return falseExpr, err
-	}
-	b, err = getNumber(r)
+	c, err := compareLiterals(l, r)
 	if err != nil {
-		return falseExpr, err
+		return nil, err
 	}
-	return &BooleanLiteral{Val: (a <= b)}, nil
+	return &BooleanLiteral{Val: c != unordered && c <= 0}, nil
+}
+
+// compareLiterals orders two numbers, times or durations, see unordered
+func compareLiterals(l, r Expr) (int, error) {
+	return compareValues(literalToValue(l), literalToValue(r))
 }
 
 // getBoolean performs type assertion and returns boolean value or error
@@ -435,19 +694,37 @@ func getString(e Expr) (string, error) {
 	switch n := e.(type) {
 	case *StringLiteral:
 		return n.Val, nil
+	case *RegexLiteral:
+		return n.Val.String(), nil
 	default:
 		return "", fmt.Errorf("Literal is not a string: %v", n)
 	}
 }
 
+// getRegexp returns the compiled regular expression of a pattern or error
+func getRegexp(e Expr) (*regexp.Regexp, error) {
+	if n, ok := e.(*RegexLiteral); ok {
+		return n.Val, nil
+	}
+	pattern, err := getString(e)
+	if err != nil {
+		return nil, err
+	}
+	return patterns.compile(pattern)
+}
+
 // getSliceNumber performs type assertion and returns []float64 value or error
 func getSliceNumber(e Expr) ([]float64, error) {
 	switch n := e.(type) {
 	case *SliceNumberLiteral:
 		return n.Val, nil
-	default:
-		return []float64{}, fmt.Errorf("Literal is not a slice of float64: %v", n)
+	case *SliceStringLiteral:
+		// An empty array argument is a []string, it has no element type.
+		if len(n.Val) == 0 {
+			return nil, nil
+		}
 	}
+	return []float64{}, fmt.Errorf("Literal is not a slice of float64: %v", e)
 }
 
 // getSliceString performs type assertion and returns []string value or error
@@ -460,6 +737,26 @@ func getSliceString(e Expr) ([]string, error) {
 	}
 }
 
+// getTime performs type assertion and returns time.Time value or error
+func getTime(e Expr) (time.Time, error) {
+	switch n := e.(type) {
+	case *TimeLiteral:
+		return n.Val, nil
+	default:
+		return time.Time{}, fmt.Errorf("Literal is not a time: %v", n)
+	}
+}
+
+// getDuration performs type assertion and returns time.Duration value or error
+func getDuration(e Expr) (time.Duration, error) {
+	switch n := e.(type) {
+	case *DurationLiteral:
+		return n.Val, nil
+	default:
+		return 0, fmt.Errorf("Literal is not a duration: %v", n)
+	}
+}
+
 // getNumber performs type assertion and returns float64 value or error
 func getNumber(e Expr) (float64, error) {
 	switch n := e.(type) {
@@ -0,0 +1,173 @@
+package conditions
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Explanation tells why an expression evaluated to its result.
+type Explanation struct {
+	Result bool
+	// Reasons are the leaf conditions deciding the result
+	Reasons []Reason
+}
+
+// String returns a sentence per reason, one per line.
+func (e *Explanation) String() string {
+	lines := make([]string, len(e.Reasons))
+	for i, r := range e.Reasons {
+		lines[i] = r.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Reason is a leaf condition, a comparison or a boolean operand, and its
+// value.
+type Reason struct {
+	Expr  Expr
+	Value bool
+	// Op is the operator of a comparison, ILLEGAL for boolean operands
+	Op Token
+	// LHS and RHS are the values of the operands of a comparison
+	LHS, RHS Expr
+}
+
+// comparisonPhrases describes the comparison operators, the negated ones
+// by the phrase of their opposite.
+var comparisonPhrases = map[Token]struct {
+	phrase  string
+	negated bool
+}{
+	EQ:    {"equal to", false},
+	NEQ:   {"equal to", true},
+	GT:    {"greater than", false},
+	GTE:   {"greater than or equal to", false},
+	LT:    {"less than", false},
+	LTE:   {"less than or equal to", false},
+	IN:    {"in", false},
+	NOTIN: {"in", true},
+	EREG:  {"matching", false},
+	NEREG: {"matching", true},
+}
+
+// String returns the reason as a sentence, e.g. `[cpu] (0.5) is not
+// greater than 0.9`.
+func (r Reason) String() string {
+	p, ok := comparisonPhrases[r.Op]
+	if !ok {
+		return fmt.Sprintf("%s is %t", Format(r.Expr), r.Value)
+	}
+	n := r.Expr.(*BinaryExpr)
+	not := ""
+	if r.Value == p.negated {
+		not = "not "
+	}
+	return fmt.Sprintf("%s is %s%s %s", describe(n.LHS, r.LHS), not, p.phrase, describe(n.RHS, r.RHS))
+}
+
+// describe returns an operand followed by its value unless it is a
+// literal.
+func describe(expr, value Expr) string {
+	if isConstant(unparen(expr)) {
+		return Format(expr)
+	}
+	return fmt.Sprintf("%s (%s)", Format(expr), Format(value))
+}
+
+// Explain evaluates expr like Evaluate and returns the minimal set of leaf
+// conditions deciding the result: the false operands of a false AND, all
+// the operands of a true one, the true operands of a true OR and all the
+// operands of a false one. NAND is explained as the negated AND and both
+// operands of XOR decide. Operands skipped by short-circuiting are
+// evaluated too, the ones failing to evaluate are left out.
+func Explain(expr Expr, args map[string]interface{}) (*Explanation, error) {
+	r, err := Evaluate(expr, args)
+	if err != nil {
+		return nil, err
+	}
+	_, reasons, err := explain(expr, &mapResolver{args: args})
+	if err != nil {
+		return nil, err
+	}
+	return &Explanation{Result: r, Reasons: reasons}, nil
+}
+
+// explain returns the value of a boolean expression and its reasons.
+func explain(expr Expr, args resolver) (bool, []Reason, error) {
+	switch n := unparen(expr).(type) {
+	case *UnaryExpr:
+		if n.Op == NOT {
+			v, reasons, err := explain(n.Expr, args)
+			return !v, reasons, err
+		}
+	case *BinaryExpr:
+		if isLogical(n.Op) {
+			return explainLogical(n, args)
+		}
+	}
+	return explainLeaf(unparen(expr), args)
+}
+
+func explainLogical(n *BinaryExpr, args resolver) (bool, []Reason, error) {
+	l, lr, lerr := explain(n.LHS, args)
+	r, rr, rerr := explain(n.RHS, args)
+
+	// An operand failing to evaluate is ignored when the other one
+	// decides the result alone: false for AND and NAND, true for OR. It is
+	// the result of AND and OR, NAND negates it.
+	decisive, negate := n.Op == OR, n.Op == NAND
+	switch {
+	case n.Op == XOR:
+	case lerr != nil && rerr == nil && r == decisive:
+		return r != negate, rr, nil
+	case rerr != nil && lerr == nil && l == decisive:
+		return l != negate, lr, nil
+	}
+	if lerr != nil {
+		return false, nil, lerr
+	}
+	if rerr != nil {
+		return false, nil, rerr
+	}
+
+	var v bool
+	switch n.Op {
+	case AND:
+		v = l && r
+	case OR:
+		v = l || r
+	case NAND:
+		v = !(l && r)
+	case XOR:
+		v = l != r
+	}
+	if n.Op == XOR || l == r {
+		return v, append(lr, rr...), nil
+	}
+	// The operand of the decisive value alone decides.
+	if l == decisive {
+		return v, lr, nil
+	}
+	return v, rr, nil
+}
+
+func explainLeaf(expr Expr, args resolver) (bool, []Reason, error) {
+	v, err := evaluateSubtree(expr, args)
+	if err != nil {
+		return false, nil, err
+	}
+	b, err := getBoolean(v)
+	if err != nil {
+		return false, nil, err
+	}
+	reason := Reason{Expr: expr, Value: b}
+	if n, ok := expr.(*BinaryExpr); ok {
+		if _, ok := comparisonPhrases[n.Op]; ok {
+			reason.Op = n.Op
+			// Both operands evaluated fine along with the comparison.
+			reason.LHS, _ = evaluateSubtree(n.LHS, args)
+			reason.RHS, _ = evaluateSubtree(n.RHS, args)
+		}
+	}
+	return b, []Reason{reason}, nil
+}
@@ -0,0 +1,88 @@
+package conditions
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplain(t *testing.T) {
+	args := map[string]interface{}{
+		"cpu":    0.5,
+		"mem":    512,
+		"limit":  1024,
+		"host":   "c",
+		"status": "503",
+		"vip":    false,
+	}
+	data := []struct {
+		cond    string
+		result  bool
+		reasons []string
+	}{
+		{`[cpu] > 0.9`, false, []string{`[cpu] (0.5) is not greater than 0.9`}},
+		{`[cpu] > 0.9 AND [mem] >= [limit] AND [host] in ["c"]`, false, []string{
+			`[cpu] (0.5) is not greater than 0.9`,
+			`[mem] (512) is not greater than or equal to [limit] (1024)`,
+		}},
+		{`([cpu] < 0.9 AND [host] == "c")`, true, []string{
+			`[cpu] (0.5) is less than 0.9`,
+			`[host] ("c") is equal to "c"`,
+		}},
+		{`[cpu] > 0.9 OR ([mem] > 1024 OR [vip])`, false, []string{
+			`[cpu] (0.5) is not greater than 0.9`,
+			`[mem] (512) is not greater than 1024`,
+			`[vip] is false`,
+		}},
+		{`[cpu] > 0.9 OR [status] =~ /^5/ OR [host] != "c"`, true, []string{`[status] ("503") is matching /^5/`}},
+		{`[host] not in ["a", "b"] AND [status] !~ "^2"`, true, []string{
+			`[host] ("c") is not in ["a", "b"]`,
+			`[status] ("503") is not matching "^2"`,
+		}},
+		{`NOT ([cpu] < 1 AND [vip])`, true, []string{`[vip] is false`}},
+		{`[cpu] < 1 NAND [vip]`, true, []string{`[vip] is false`}},
+		{`[cpu] < 1 NAND NOT [vip]`, false, []string{`[cpu] (0.5) is less than 1`, `[vip] is false`}},
+		{`[cpu] < 1 XOR [vip]`, true, []string{`[cpu] (0.5) is less than 1`, `[vip] is false`}},
+		{`[mem] + 512 == [limit]`, true, []string{`[mem] + 512 (1024) is equal to [limit] (1024)`}},
+
+		// Operands failing to evaluate do not decide.
+		{`[vip] AND [missing] > 1`, false, []string{`[vip] is false`}},
+		{`[missing] > 1 OR [cpu] < 1`, false, nil},
+	}
+
+	for _, td := range data {
+		expr, err := NewParser(strings.NewReader(td.cond)).Parse()
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+		e, err := Explain(expr, args)
+		if td.reasons == nil {
+			assert.NotNil(t, err, td.cond)
+			continue
+		}
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+		assert.Equal(t, td.result, e.Result, td.cond)
+		assert.Equal(t, strings.Join(td.reasons, "\n"), e.String(), td.cond)
+	}
+}
+
+func TestExplainReason(t *testing.T) {
+	expr, err := NewParser(strings.NewReader(`[a] > 1 OR [b]`)).Parse()
+	assert.Nil(t, err)
+	e, err := Explain(expr, map[string]interface{}{"a": 0, "b": false})
+	if assert.Nil(t, err) && assert.Len(t, e.Reasons, 2) {
+		r := e.Reasons[0]
+		assert.Equal(t, GT, r.Op)
+		assert.False(t, r.Value)
+		assert.Equal(t, &NumberLiteral{Val: 0}, r.LHS)
+		assert.Equal(t, &NumberLiteral{Val: 1}, r.RHS)
+		assert.Equal(t, `[a] > 1`, Format(r.Expr))
+
+		r = e.Reasons[1]
+		assert.Equal(t, ILLEGAL, r.Op)
+		assert.Equal(t, &VarRef{Val: "b", Path: []string{"b"}}, r.Expr)
+	}
+}
@@ -0,0 +1,217 @@
+package conditions
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format returns the canonical source of an expression. Redundant
+// parentheses are dropped and the required ones added based on the
+// operator precedence, the parser reads the source back to an expression
+// structurally equal to expr, see Equal.
+func Format(expr Expr) string {
+	var b strings.Builder
+	formatExpr(&b, expr)
+	return b.String()
+}
+
+func formatExpr(b *strings.Builder, expr Expr) {
+	switch n := unparen(expr).(type) {
+	case nil:
+	case *BinaryExpr:
+		// Operators are left-associative, a right operand of the same
+		// precedence needs parentheses. NOT applies to the comparison
+		// following it, a negated operand of a comparison or arithmetic
+		// needs them too.
+		l, r := precedence(n.LHS), precedence(n.RHS)
+		negated := n.Op.Precedence() >= EQ.Precedence()
+		formatOperand(b, n.LHS, l > 0 && l < n.Op.Precedence() || negated && isNot(n.LHS))
+		b.WriteString(" " + n.Op.String() + " ")
+		formatOperand(b, n.RHS, r > 0 && r <= n.Op.Precedence() || negated && isNot(n.RHS))
+	case *UnaryExpr:
+		// IS [NOT] NULL follows a variable reference, EXISTS binds
+		// tighter than any binary operator.
+		if n.Op == ISNULL || n.Op == ISNOTNULL {
+			formatExpr(b, n.Expr)
+			b.WriteString(" " + n.Op.String())
+			break
+		}
+		b.WriteString(n.Op.String() + " ")
+		formatOperand(b, n.Expr, precedence(n.Expr) > 0)
+	case *CallExpr:
+		b.WriteString(n.Name + "(")
+		for i, arg := range n.Arguments {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			formatExpr(b, arg)
+		}
+		b.WriteString(")")
+	case *VarRef:
+		path := n.Path
+		if len(path) == 0 {
+			path = strings.Split(n.Val, ".")
+		}
+		for _, segment := range path {
+			b.WriteString("[" + segment + "]")
+		}
+	case *NumberLiteral:
+		b.WriteString(formatNumber(n.Val))
+	case *StringLiteral:
+		b.WriteString(Quote(n.Val))
+	case *RegexLiteral:
+		b.WriteString("/" + strings.Replace(n.Pattern, "/", `\/`, -1) + "/" + n.Flags)
+	case *BooleanLiteral:
+		b.WriteString(strconv.FormatBool(n.Val))
+	case *nullLiteral:
+		// Only found in the values of a Trace.
+		b.WriteString("NULL")
+	case *SliceStringLiteral:
+		b.WriteString("[")
+		for i, s := range n.Val {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(Quote(s))
+		}
+		b.WriteString("]")
+	case *SliceNumberLiteral:
+		b.WriteString("[")
+		for i, v := range n.Val {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			// [1] is a variable reference, a single number is signed.
+			if len(n.Val) == 1 && !math.Signbit(v) {
+				b.WriteString("+")
+			}
+			b.WriteString(formatNumber(v))
+		}
+		b.WriteString("]")
+	case *TimeLiteral:
+		b.WriteString("TIME " + Quote(n.Val.Format(time.RFC3339Nano)))
+	case *DurationLiteral:
+		b.WriteString(FormatDuration(n.Val))
+	case *BadExpr:
+		b.WriteString("<bad expression>")
+	}
+}
+
+// formatOperand formats an operand, in parentheses if paren is set.
+func formatOperand(b *strings.Builder, expr Expr, paren bool) {
+	if paren {
+		b.WriteString("(")
+	}
+	formatExpr(b, expr)
+	if paren {
+		b.WriteString(")")
+	}
+}
+
+// precedence returns the precedence of the operator of a binary
+// expression, 0 for the other expressions which never need parentheses.
+func precedence(expr Expr) int {
+	if n, ok := unparen(expr).(*BinaryExpr); ok {
+		return n.Op.Precedence()
+	}
+	return 0
+}
+
+// isNot reports whether expr is a NOT operation.
+func isNot(expr Expr) bool {
+	n, ok := unparen(expr).(*UnaryExpr)
+	return ok && n.Op == NOT
+}
+
+// unparen returns the expression within parentheses.
+func unparen(expr Expr) Expr {
+	for {
+		p, ok := expr.(*ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = p.Expr
+	}
+}
+
+// formatNumber returns the shortest representation of a number which
+// reads back to the same value.
+func formatNumber(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Equal reports whether two expressions are structurally equal, ignoring
+// parentheses. Called functions are compared by name.
+func Equal(a, b Expr) bool {
+	a, b = unparen(a), unparen(b)
+	switch x := a.(type) {
+	case nil:
+		return b == nil
+	case *BinaryExpr:
+		y, ok := b.(*BinaryExpr)
+		return ok && x.Op == y.Op && Equal(x.LHS, y.LHS) && Equal(x.RHS, y.RHS)
+	case *UnaryExpr:
+		y, ok := b.(*UnaryExpr)
+		return ok && x.Op == y.Op && Equal(x.Expr, y.Expr)
+	case *CallExpr:
+		y, ok := b.(*CallExpr)
+		if !ok || x.Name != y.Name || len(x.Arguments) != len(y.Arguments) {
+			return false
+		}
+		for i := range x.Arguments {
+			if !Equal(x.Arguments[i], y.Arguments[i]) {
+				return false
+			}
+		}
+		return true
+	case *VarRef:
+		y, ok := b.(*VarRef)
+		return ok && x.Val == y.Val
+	case *NumberLiteral:
+		y, ok := b.(*NumberLiteral)
+		return ok && (x.Val == y.Val || math.IsNaN(x.Val) && math.IsNaN(y.Val))
+	case *StringLiteral:
+		y, ok := b.(*StringLiteral)
+		return ok && x.Val == y.Val
+	case *RegexLiteral:
+		y, ok := b.(*RegexLiteral)
+		return ok && x.Pattern == y.Pattern && x.Flags == y.Flags
+	case *BooleanLiteral:
+		y, ok := b.(*BooleanLiteral)
+		return ok && x.Val == y.Val
+	case *nullLiteral:
+		_, ok := b.(*nullLiteral)
+		return ok
+	case *SliceStringLiteral:
+		y, ok := b.(*SliceStringLiteral)
+		if !ok || len(x.Val) != len(y.Val) {
+			return false
+		}
+		for i := range x.Val {
+			if x.Val[i] != y.Val[i] {
+				return false
+			}
+		}
+		return true
+	case *SliceNumberLiteral:
+		y, ok := b.(*SliceNumberLiteral)
+		if !ok || len(x.Val) != len(y.Val) {
+			return false
+		}
+		for i := range x.Val {
+			if x.Val[i] != y.Val[i] {
+				return false
+			}
+		}
+		return true
+	case *TimeLiteral:
+		y, ok := b.(*TimeLiteral)
+		return ok && x.Val.Equal(y.Val)
+	case *DurationLiteral:
+		y, ok := b.(*DurationLiteral)
+		return ok && x.Val == y.Val
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package conditions
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormat(t *testing.T) {
+	data := []struct {
+		cond string
+		want string
+	}{
+		{`[var0]`, `[var0]`},
+		{`$0 > 1 AND foo`, `[$0] > 1 AND [foo]`},
+		{`[a][b][0] == 'x'`, `[a][b][0] == "x"`},
+		{`[a] == 0.1 OR [b] == 1e21 OR [c] == -2.5`, `[a] == 0.1 OR [b] == 1e+21 OR [c] == -2.5`},
+		{`[a] in ["x", 'y"z']`, `[a] IN ["x", "y\"z"]`},
+		{`[a] not in [1,2.5]`, `[a] NOT IN [1, 2.5]`},
+		{`((true)) and (false)`, `true AND false`},
+		{`(true OR false) AND false`, `(true OR false) AND false`},
+		{`true OR (false AND false)`, `true OR false AND false`},
+		{`(1 + 2) * 3 == 9`, `(1 + 2) * 3 == 9`},
+		{`1 + (2 * 3) == 7`, `1 + 2 * 3 == 7`},
+		{`10 - (2 - 3) == 11`, `10 - (2 - 3) == 11`},
+		{`(10 - 2) - 3 == 5`, `10 - 2 - 3 == 5`},
+		{`!([a] > 5) OR ![b]`, `NOT ([a] > 5) OR NOT [b]`},
+		{`[d] > 1h30m AND [t] < TIME "2017-09-13"`, `[d] > 90m AND [t] < TIME "2017-09-13T00:00:00Z"`},
+		{`[s] =~ /^\/a b/i`, `[s] =~ /^\/a b/i`},
+		{`lower( [a] ) == "x" AND max([a], 1 + 2) > 0`, `lower([a]) == "x" AND max([a], 1 + 2) > 0`},
+		{`exists [a][b] and not [c]  is  not  null`, `EXISTS [a][b] AND NOT [c] IS NOT NULL`},
+		{`([a] is null) == false`, `[a] IS NULL == false`},
+		{`NOT [a] == 1 AND NOT [b] IN [1, 2]`, `NOT ([a] == 1) AND NOT ([b] IN [1, 2])`},
+		{`(NOT [a]) == true`, `(NOT [a]) == true`},
+		{`true == (NOT [a])`, `true == (NOT [a])`},
+	}
+
+	funcs := NewFunctionRegistry()
+	assert.Nil(t, funcs.Register("lower", strings.ToLower))
+	assert.Nil(t, funcs.Register("max", func(a, b float64) float64 { return a }))
+
+	for _, td := range data {
+		p := NewParser(strings.NewReader(td.cond))
+		p.SetFunctions(funcs)
+		expr, err := p.Parse()
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+		assert.Equal(t, td.want, Format(expr), td.cond)
+		assert.Equal(t, td.want, expr.String(), td.cond)
+
+		// The output reads back to the same expression and is canonical.
+		p = NewParser(strings.NewReader(Format(expr)))
+		p.SetFunctions(funcs)
+		again, err := p.Parse()
+		if assert.Nil(t, err, td.cond) {
+			assert.True(t, Equal(expr, again), td.cond)
+			assert.Equal(t, td.want, Format(again), td.cond)
+		}
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	for _, td := range validTestData {
+		expr, err := NewParser(strings.NewReader(td.cond)).Parse()
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+		again, err := NewParser(strings.NewReader(Format(expr))).Parse()
+		if assert.Nil(t, err, Format(expr)) {
+			assert.True(t, Equal(expr, again), Format(expr))
+		}
+	}
+}
+
+func TestFormatBuiltExpressions(t *testing.T) {
+	a, b, c := &VarRef{Val: "a"}, &VarRef{Val: "b"}, &VarRef{Val: "c"}
+	data := []struct {
+		expr Expr
+		want string
+	}{
+		{&BinaryExpr{Op: AND, LHS: &BinaryExpr{Op: OR, LHS: a, RHS: b}, RHS: c}, `([a] OR [b]) AND [c]`},
+		{&BinaryExpr{Op: OR, LHS: a, RHS: &BinaryExpr{Op: OR, LHS: b, RHS: c}}, `[a] OR ([b] OR [c])`},
+		{&BinaryExpr{Op: GT, LHS: &BinaryExpr{Op: SUB, LHS: a, RHS: &BinaryExpr{Op: SUB, LHS: b, RHS: c}}, RHS: &NumberLiteral{Val: -1}}, `[a] - ([b] - [c]) > -1`},
+		{&UnaryExpr{Op: NOT, Expr: &BinaryExpr{Op: AND, LHS: a, RHS: b}}, `NOT ([a] AND [b])`},
+		{&BinaryExpr{Op: EQ, LHS: &BinaryExpr{Op: ADD, LHS: a, RHS: &UnaryExpr{Op: NOT, Expr: b}}, RHS: c}, `[a] + (NOT [b]) == [c]`},
+		{&BinaryExpr{Op: EQ, LHS: &VarRef{Val: "x.y"}, RHS: &DurationLiteral{Val: -1500 * time.Millisecond}}, `[x][y] == -1500ms`},
+		{&BinaryExpr{Op: IN, LHS: &VarRef{Val: "1"}, RHS: &SliceNumberLiteral{Val: []float64{1}}}, `[1] IN [+1]`},
+		{&BinaryExpr{Op: IN, LHS: &VarRef{Val: "2"}, RHS: &SliceNumberLiteral{Val: []float64{-1, 2}}}, `[2] IN [-1, 2]`},
+	}
+
+	for _, td := range data {
+		assert.Equal(t, td.want, Format(td.expr))
+		again, err := NewParser(strings.NewReader(Format(td.expr))).Parse()
+		if assert.Nil(t, err, td.want) {
+			assert.True(t, Equal(td.expr, again), td.want)
+		}
+	}
+}
+
+func TestEqual(t *testing.T) {
+	parse := func(s string) Expr {
+		expr, err := NewParser(strings.NewReader(s)).Parse()
+		assert.Nil(t, err, s)
+		return expr
+	}
+	assert.True(t, Equal(parse(`([a] > 1)`), parse(`[a] > 1`)))
+	assert.True(t, Equal(parse(`[a] in [1, 2]`), parse(`[a] IN [1,2]`)))
+	assert.False(t, Equal(parse(`[a] > 1`), parse(`[a] >= 1`)))
+	assert.False(t, Equal(parse(`[a] in [1, 2]`), parse(`[a] in [2, 1]`)))
+	assert.False(t, Equal(parse(`[a] =~ /x/`), parse(`[a] =~ /x/i`)))
+	assert.False(t, Equal(parse(`[a] == "1"`), parse(`[a] == 1`)))
+}
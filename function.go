@@ -0,0 +1,205 @@
+package conditions
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var (
+	errorType    = reflect.TypeOf((*error)(nil)).Elem()
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// Function is a Go function which can be called from conditions. Its
+// signature is derived from the Go function type when it is registered.
+type Function struct {
+	Name   string
+	Params []DataType
+	Result DataType
+
+	fn     reflect.Value
+	hasErr bool
+}
+
+// FunctionRegistry holds the functions available to the parser. It is
+// safe for concurrent use.
+type FunctionRegistry struct {
+	mu    sync.RWMutex
+	funcs map[string]*Function
+}
+
+// NewFunctionRegistry returns an empty registry.
+func NewFunctionRegistry() *FunctionRegistry {
+	return &FunctionRegistry{funcs: map[string]*Function{}}
+}
+
+// Register adds a Go function under the given name. Parameters and the
+// result may be float64, int, int64, string, bool, []string, []float64,
+// time.Time, time.Duration or interface{} (any value), named types such as
+// type Level int are rejected; the function may return an error as its
+// second result. Numbers are passed to int parameters only if integral.
+func (r *FunctionRegistry) Register(name string, fn interface{}) error {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func {
+		return fmt.Errorf("Function %s is not a func but %T", name, fn)
+	}
+	t := v.Type()
+	if t.IsVariadic() {
+		return fmt.Errorf("Function %s: variadic functions are not supported", name)
+	}
+
+	f := &Function{Name: name, fn: v}
+	for i := 0; i < t.NumIn(); i++ {
+		dt, ok := goDataType(t.In(i))
+		if !ok {
+			return fmt.Errorf("Function %s: unsupported argument %d type: %s", name, i+1, t.In(i))
+		}
+		f.Params = append(f.Params, dt)
+	}
+
+	switch {
+	case t.NumOut() == 2 && t.Out(1) == errorType:
+		f.hasErr = true
+	case t.NumOut() != 1:
+		return fmt.Errorf("Function %s must return a value and optionally an error", name)
+	}
+	dt, ok := goDataType(t.Out(0))
+	if !ok {
+		return fmt.Errorf("Function %s: unsupported result type: %s", name, t.Out(0))
+	}
+	f.Result = dt
+
+	r.mu.Lock()
+	r.funcs[name] = f
+	r.mu.Unlock()
+	return nil
+}
+
+// Lookup returns the function registered under the given name.
+func (r *FunctionRegistry) Lookup(name string) (*Function, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	f, ok := r.funcs[name]
+	return f, ok
+}
+
+// goDataType maps a Go type to the data type of conditions. Named types
+// other than time.Time and time.Duration, e.g. type Level int, are not
+// supported as their values would not convert back.
+func goDataType(t reflect.Type) (DataType, bool) {
+	switch t {
+	case timeType:
+		return Time, true
+	case durationType:
+		return Duration, true
+	}
+	if t.PkgPath() != "" {
+		return Unknown, false
+	}
+	switch t.Kind() {
+	case reflect.Float64, reflect.Int, reflect.Int64:
+		return Number, true
+	case reflect.String:
+		return String, true
+	case reflect.Bool:
+		return Boolean, true
+	case reflect.Interface:
+		return Unknown, t.NumMethod() == 0
+	case reflect.Slice:
+		if t.Elem().PkgPath() != "" {
+			return Unknown, false
+		}
+		switch t.Elem().Kind() {
+		case reflect.String:
+			return SliceString, true
+		case reflect.Float64:
+			return SliceNumber, true
+		}
+	}
+	return Unknown, false
+}
+
+// checkArgs verifies arity and the types of the arguments known before
+// evaluation.
+func (f *Function) checkArgs(args []Expr) error {
+	if len(args) != len(f.Params) {
+		return fmt.Errorf("Function %s expects %d arguments, got %d", f.Name, len(f.Params), len(args))
+	}
+	for i, arg := range args {
+		want, got := f.Params[i], staticType(arg)
+		if want != Unknown && got != Unknown && want != got {
+			return fmt.Errorf("Function %s expects %s as argument %d, got %s", f.Name, want, i+1, got)
+		}
+	}
+	return nil
+}
+
+// Call invokes the function with the given argument values.
+func (f *Function) Call(args []interface{}) (interface{}, error) {
+	if len(args) != len(f.Params) {
+		return nil, fmt.Errorf("Function %s expects %d arguments, got %d", f.Name, len(f.Params), len(args))
+	}
+	t := f.fn.Type()
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		if f.Params[i] != Unknown && InspectDataType(arg) != f.Params[i] {
+			return nil, fmt.Errorf("Function %s expects %s as argument %d, got %v", f.Name, f.Params[i], i+1, arg)
+		}
+		if arg == nil {
+			in[i] = reflect.Zero(t.In(i))
+			continue
+		}
+		// Numbers are not truncated to integer parameters.
+		if n, ok := arg.(float64); ok && t.In(i).Kind() != reflect.Float64 && t.In(i).Kind() != reflect.Interface &&
+			(n != math.Trunc(n) || n < math.MinInt64 || n >= math.MaxInt64) {
+			return nil, fmt.Errorf("Function %s expects an integer as argument %d, got %v", f.Name, i+1, arg)
+		}
+		in[i] = reflect.ValueOf(arg).Convert(t.In(i))
+	}
+
+	out := f.fn.Call(in)
+	if f.hasErr && !out[1].IsNil() {
+		return nil, out[1].Interface().(error)
+	}
+	return out[0].Interface(), nil
+}
+
+// staticType returns the type an expression evaluates to when it can be
+// told without evaluating it.
+func staticType(expr Expr) DataType {
+	switch n := expr.(type) {
+	case *ParenExpr:
+		return staticType(n.Expr)
+	case *NumberLiteral:
+		return Number
+	case *StringLiteral, *RegexLiteral:
+		return String
+	case *BooleanLiteral:
+		return Boolean
+	case *SliceStringLiteral:
+		return SliceString
+	case *SliceNumberLiteral:
+		return SliceNumber
+	case *TimeLiteral:
+		return Time
+	case *DurationLiteral:
+		return Duration
+	case *CallExpr:
+		if n.Func != nil {
+			return n.Func.Result
+		}
+	case *UnaryExpr:
+		return Boolean
+	case *BinaryExpr:
+		switch n.Op {
+		case ADD, SUB, MUL, DIV, MOD:
+			return arithmeticType(n.Op, staticType(n.LHS), staticType(n.RHS))
+		}
+		return Boolean
+	}
+	return Unknown
+}
@@ -0,0 +1,118 @@
+package conditions
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testFunctions(t *testing.T) *FunctionRegistry {
+	funcs := NewFunctionRegistry()
+	assert.Nil(t, funcs.Register("lower", strings.ToLower))
+	assert.Nil(t, funcs.Register("len", func(v []string) int { return len(v) }))
+	assert.Nil(t, funcs.Register("max", func(a, b float64) float64 {
+		if a > b {
+			return a
+		}
+		return b
+	}))
+	assert.Nil(t, funcs.Register("fail", func() (bool, error) { return false, fmt.Errorf("failed") }))
+	assert.Nil(t, funcs.Register("isset", func(v interface{}) bool { return v != nil }))
+	assert.Nil(t, funcs.Register("half", func(n int) int { return n / 2 }))
+	return funcs
+}
+
+func TestFunctionRegister(t *testing.T) {
+	funcs := NewFunctionRegistry()
+	assert.NotNil(t, funcs.Register("notfunc", 42))
+	assert.NotNil(t, funcs.Register("variadic", fmt.Sprint))
+	assert.NotNil(t, funcs.Register("noresult", func(string) {}))
+	assert.NotNil(t, funcs.Register("badarg", func(map[string]string) bool { return true }))
+	assert.NotNil(t, funcs.Register("badresult", func() (bool, bool) { return true, true }))
+	assert.NotNil(t, funcs.Register("namedarg", func(testStatus) bool { return true }))
+	assert.NotNil(t, funcs.Register("namedresult", func() testStatus { return "" }))
+	assert.NotNil(t, funcs.Register("namedslice", func([]testStatus) bool { return true }))
+
+	assert.Nil(t, funcs.Register("lower", strings.ToLower))
+	f, ok := funcs.Lookup("lower")
+	assert.True(t, ok)
+	assert.Equal(t, []DataType{String}, f.Params)
+	assert.Equal(t, String, f.Result)
+}
+
+func TestFunctionCalls(t *testing.T) {
+	funcs := testFunctions(t)
+
+	data := []struct {
+		cond   string
+		args   map[string]interface{}
+		result bool
+		isErr  bool
+	}{
+		{`lower([name]) == "admin"`, map[string]interface{}{"name": "ADMIN"}, true, false},
+		{`lower([name]) == "admin"`, map[string]interface{}{"name": "guest"}, false, false},
+		{`len([tags]) > 2`, map[string]interface{}{"tags": []string{"a", "b", "c"}}, true, false},
+		{`max([a], [b] * 2) == 10`, map[string]interface{}{"a": 3, "b": 5}, true, false},
+		{`max(1, max(2, 3)) == 3`, nil, true, false},
+		{`fail()`, nil, false, true},
+		{`isset([a])`, map[string]interface{}{"a": "x"}, true, false},
+		{`lower([name]) == "admin"`, map[string]interface{}{"name": 5}, false, true},
+		{`half([a]) == 2`, map[string]interface{}{"a": 4}, true, false},
+		{`half(3.9) == 1`, nil, false, true},
+		{`half([a]) == 1`, map[string]interface{}{"a": 1e300}, false, true},
+	}
+
+	for _, td := range data {
+		p := NewParser(strings.NewReader(td.cond))
+		p.SetFunctions(funcs)
+		expr, err := p.Parse()
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+
+		r, err := Evaluate(expr, td.args)
+		assert.Equal(t, td.isErr, err != nil, td.cond)
+		assert.Equal(t, td.result, r, td.cond)
+
+		prg, err := Compile(expr)
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+		r, err = prg.Evaluate(td.args)
+		assert.Equal(t, td.isErr, err != nil, td.cond)
+		assert.Equal(t, td.result, r, td.cond)
+	}
+}
+
+func TestFunctionCallErrors(t *testing.T) {
+	funcs := testFunctions(t)
+
+	for _, cond := range []string{
+		`unknown([a])`,
+		`lower(1) == "a"`,
+		`lower("a", "b") == "a"`,
+		`max(1) > 0`,
+		`len(["a"], ) > 0`,
+		`lower("a"`,
+	} {
+		p := NewParser(strings.NewReader(cond))
+		p.SetFunctions(funcs)
+		expr, err := p.Parse()
+		assert.NotNil(t, err, cond)
+		assert.Nil(t, expr, cond)
+	}
+}
+
+func TestFunctionCallVariables(t *testing.T) {
+	p := NewParser(strings.NewReader(`lower([name]) == "admin" AND max([a], [b][c]) > 1`))
+	p.SetFunctions(testFunctions(t))
+	expr, err := p.Parse()
+	assert.Nil(t, err)
+
+	args := Variables(expr)
+	assert.Contains(t, args, "name")
+	assert.Contains(t, args, "a")
+	assert.Contains(t, args, "b.c")
+}
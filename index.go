@@ -0,0 +1,378 @@
+package conditions
+
+import (
+	"math"
+	"sort"
+)
+
+// maxIndexClauses is the maximum number of DNF clauses of an indexed rule,
+// rules of more clauses are always evaluated.
+const maxIndexClauses = 32
+
+// swapped maps the comparison operators to the ones giving the same
+// result with swapped operands.
+var swapped = map[Token]Token{EQ: EQ, GT: LT, GTE: LTE, LT: GT, LTE: GTE}
+
+// ruleIndex narrows down the rules of a RuleSet to the candidates which
+// may match the args. Every clause of the disjunctive normal form of a
+// rule is indexed by one of its comparisons, which must hold for the
+// clause to match: an equality or IN list in a hash index, otherwise the
+// numeric ranges of a variable in an interval tree. Rules having a clause
+// without such comparison are candidates for all args.
+//
+// Negated comparisons are replaced by the opposite ones in the normal form,
+// which differ for NaN and null: the ranges of a variable are all
+// candidates when it is NaN, and with MissingNull and MissingFalse the rules
+// having a negation are not indexed.
+type ruleIndex struct {
+	hash      map[string]map[interface{}][]*Rule
+	ranges    map[string]*intervalTree
+	unindexed []*Rule
+	// nulls is set when missing variables evaluate to null
+	nulls bool
+}
+
+// indexKey is the comparison indexing a clause of a rule.
+type indexKey struct {
+	field string
+	// values holds the keys of the hash index, ranges are indexed by
+	// interval otherwise
+	values   []interface{}
+	interval interval
+}
+
+func newRuleIndex(missing MissingMode) *ruleIndex {
+	return &ruleIndex{
+		hash:   make(map[string]map[interface{}][]*Rule),
+		ranges: make(map[string]*intervalTree),
+		nulls:  missing != MissingError,
+	}
+}
+
+// add indexes the rule.
+func (ix *ruleIndex) add(r *Rule) {
+	r.keys = nil
+	if !ix.nulls || !hasNegation(r.Expr) {
+		r.keys = indexKeys(r.Expr)
+	}
+	if r.keys == nil {
+		ix.unindexed = append(ix.unindexed, r)
+		return
+	}
+	for _, k := range r.keys {
+		if k.values == nil {
+			t, ok := ix.ranges[k.field]
+			if !ok {
+				t = &intervalTree{}
+				ix.ranges[k.field] = t
+			}
+			iv := k.interval
+			iv.rule = r
+			t.intervals = append(t.intervals, iv)
+			t.dirty = true
+			continue
+		}
+		m, ok := ix.hash[k.field]
+		if !ok {
+			m = make(map[interface{}][]*Rule)
+			ix.hash[k.field] = m
+		}
+		for _, v := range k.values {
+			m[v] = append(m[v], r)
+		}
+	}
+}
+
+// remove removes the rule from the index.
+func (ix *ruleIndex) remove(r *Rule) {
+	if r.keys == nil {
+		ix.unindexed = removeRule(ix.unindexed, r)
+		return
+	}
+	for _, k := range r.keys {
+		if k.values == nil {
+			t := ix.ranges[k.field]
+			for i := range t.intervals {
+				if t.intervals[i].rule == r {
+					t.intervals = append(t.intervals[:i], t.intervals[i+1:]...)
+					t.dirty = true
+					break
+				}
+			}
+			if len(t.intervals) == 0 {
+				delete(ix.ranges, k.field)
+			}
+			continue
+		}
+		m := ix.hash[k.field]
+		for _, v := range k.values {
+			if m[v] = removeRule(m[v], r); len(m[v]) == 0 {
+				delete(m, v)
+			}
+		}
+		if len(m) == 0 {
+			delete(ix.hash, k.field)
+		}
+	}
+}
+
+// dirty reports whether an interval tree needs to be rebuilt.
+func (ix *ruleIndex) dirty() bool {
+	for _, t := range ix.ranges {
+		if t.dirty {
+			return true
+		}
+	}
+	return false
+}
+
+// build rebuilds the modified interval trees.
+func (ix *ruleIndex) build() {
+	for _, t := range ix.ranges {
+		if t.dirty {
+			t.build()
+		}
+	}
+}
+
+// candidates returns the rules which may match the resolved variables,
+// by priority.
+func (ix *ruleIndex) candidates(resolved map[string]interface{}) []*Rule {
+	rules := append([]*Rule{}, ix.unindexed...)
+	for field, m := range ix.hash {
+		if key, ok := indexValue(resolved[field]); ok {
+			rules = append(rules, m[key]...)
+		}
+	}
+	for field, t := range ix.ranges {
+		n, ok := indexValue(resolved[field])
+		if !ok {
+			continue
+		}
+		switch v, ok := n.(float64); {
+		case !ok:
+		case math.IsNaN(v):
+			for _, iv := range t.intervals {
+				rules = append(rules, iv.rule)
+			}
+		default:
+			rules = t.stab(v, 0, len(t.intervals), rules)
+		}
+	}
+
+	// A rule is found once per matching clause.
+	sort.Slice(rules, func(i, j int) bool { return rules[i].before(rules[j]) })
+	out := rules[:0]
+	for i, r := range rules {
+		if i == 0 || r != rules[i-1] {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// indexValue returns the hash key of an argument, equal to the key of the
+// literals it compares equal to.
+func indexValue(arg interface{}) (interface{}, bool) {
+	v, err := toValue("", arg)
+	if err != nil {
+		return nil, false
+	}
+	switch v.kind {
+	case kindNumber:
+		return v.n, true
+	case kindString:
+		return v.s, true
+	case kindBoolean:
+		return v.b, true
+	}
+	return nil, false
+}
+
+// hasNegation reports whether expr has a NOT, NAND or XOR operator.
+func hasNegation(expr Expr) bool {
+	switch n := expr.(type) {
+	case *ParenExpr:
+		return hasNegation(n.Expr)
+	case *UnaryExpr:
+		return n.Op == NOT || hasNegation(n.Expr)
+	case *BinaryExpr:
+		return n.Op == NAND || n.Op == XOR || hasNegation(n.LHS) || hasNegation(n.RHS)
+	}
+	return false
+}
+
+// indexKeys returns the keys of the clauses of the rule, nil when a clause
+// cannot be indexed.
+func indexKeys(expr Expr) []indexKey {
+	clauses, err := normalClauses(expr, OR, maxIndexClauses)
+	if err != nil {
+		return nil
+	}
+	keys := make([]indexKey, 0, len(clauses))
+	for _, clause := range clauses {
+		k, ok := clauseKey(clause)
+		if !ok {
+			return nil
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// clauseKey returns the comparison indexing the clause, an equality or IN
+// list if any, otherwise the range of the first variable compared to
+// numbers.
+func clauseKey(clause []Expr) (indexKey, bool) {
+	var (
+		fields []string
+		ranges = make(map[string]interval)
+	)
+	for _, lit := range clause {
+		switch n := lit.(type) {
+		case *VarRef:
+			return indexKey{field: n.Val, values: []interface{}{true}}, true
+		case *UnaryExpr:
+			if ref, ok := n.Expr.(*VarRef); ok && n.Op == NOT {
+				return indexKey{field: ref.Val, values: []interface{}{false}}, true
+			}
+		case *BinaryExpr:
+			op, operand := n.Op, n.RHS
+			ref, ok := n.LHS.(*VarRef)
+			if !ok {
+				// Swap the operands of 1 < [a] and "x" == [a].
+				op, operand = swapped[op], n.LHS
+				ref, ok = n.RHS.(*VarRef)
+			}
+			if !ok {
+				continue
+			}
+			switch op {
+			case EQ:
+				switch operand.(type) {
+				case *NumberLiteral, *StringLiteral, *BooleanLiteral:
+					key, _ := indexValue(literalValue(operand))
+					return indexKey{field: ref.Val, values: []interface{}{key}}, true
+				}
+			case IN:
+				if values := indexValues(operand); values != nil {
+					return indexKey{field: ref.Val, values: values}, true
+				}
+			case GT, GTE, LT, LTE:
+				num, ok := operand.(*NumberLiteral)
+				if !ok {
+					continue
+				}
+				iv, ok := ranges[ref.Val]
+				if !ok {
+					iv = interval{lo: math.Inf(-1), hi: math.Inf(1)}
+					fields = append(fields, ref.Val)
+				}
+				ranges[ref.Val] = iv.restrict(op, num.Val)
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return indexKey{}, false
+	}
+	return indexKey{field: fields[0], interval: ranges[fields[0]]}, true
+}
+
+// indexValues returns the hash keys of the elements of a slice literal.
+func indexValues(expr Expr) []interface{} {
+	var values []interface{}
+	switch n := expr.(type) {
+	case *SliceStringLiteral:
+		for _, s := range n.Val {
+			values = append(values, s)
+		}
+	case *SliceNumberLiteral:
+		for _, v := range n.Val {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// removeRule removes r from rules.
+func removeRule(rules []*Rule, r *Rule) []*Rule {
+	for i := range rules {
+		if rules[i] == r {
+			return append(rules[:i], rules[i+1:]...)
+		}
+	}
+	return rules
+}
+
+// interval is the range of numbers a comparison of a rule holds for.
+type interval struct {
+	lo, hi         float64
+	loOpen, hiOpen bool
+	rule           *Rule
+}
+
+// restrict returns the interval restricted by the comparison op c.
+func (iv interval) restrict(op Token, c float64) interval {
+	switch op {
+	case GT, GTE:
+		if c > iv.lo || c == iv.lo && op == GT {
+			iv.lo, iv.loOpen = c, op == GT
+		}
+	case LT, LTE:
+		if c < iv.hi || c == iv.hi && op == LT {
+			iv.hi, iv.hiOpen = c, op == LT
+		}
+	}
+	return iv
+}
+
+// contains reports whether the comparisons of the interval hold for v,
+// none of them holds for NaN.
+func (iv interval) contains(v float64) bool {
+	return (v > iv.lo || v == iv.lo && !iv.loOpen) && (v < iv.hi || v == iv.hi && !iv.hiOpen)
+}
+
+// intervalTree finds the intervals containing a number. The intervals are
+// sorted by lower bound as an implicit balanced binary tree, each node
+// keeps the highest upper bound of its subtree.
+type intervalTree struct {
+	intervals []interval
+	maxHi     []float64
+	dirty     bool
+}
+
+func (t *intervalTree) build() {
+	sort.Slice(t.intervals, func(i, j int) bool { return t.intervals[i].lo < t.intervals[j].lo })
+	t.maxHi = make([]float64, len(t.intervals))
+	t.fill(0, len(t.intervals))
+	t.dirty = false
+}
+
+func (t *intervalTree) fill(lo, hi int) float64 {
+	if lo >= hi {
+		return math.Inf(-1)
+	}
+	mid := (lo + hi) / 2
+	m := math.Max(t.intervals[mid].hi, math.Max(t.fill(lo, mid), t.fill(mid+1, hi)))
+	t.maxHi[mid] = m
+	return m
+}
+
+// stab appends the rules of the intervals in [lo, hi) containing v.
+func (t *intervalTree) stab(v float64, lo, hi int, rules []*Rule) []*Rule {
+	if lo >= hi {
+		return rules
+	}
+	mid := (lo + hi) / 2
+	if t.maxHi[mid] < v {
+		return rules
+	}
+	rules = t.stab(v, lo, mid, rules)
+	if t.intervals[mid].contains(v) {
+		rules = append(rules, t.intervals[mid].rule)
+	}
+	if t.intervals[mid].lo <= v {
+		rules = t.stab(v, mid+1, hi, rules)
+	}
+	return rules
+}
@@ -0,0 +1,195 @@
+package conditions
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// randomRule returns a condition of one of the shapes the index handles,
+// or not.
+func randomRule(rnd *rand.Rand) string {
+	lo := rnd.Intn(100)
+	switch rnd.Intn(8) {
+	case 0:
+		return fmt.Sprintf(`[country] == "c%d" AND [age] >= %d AND [age] < %d`, rnd.Intn(20), lo, lo+rnd.Intn(30))
+	case 1:
+		return fmt.Sprintf(`[tier] in [%d, %d] AND [vip]`, rnd.Intn(10), rnd.Intn(10))
+	case 2:
+		return fmt.Sprintf(`[score] > %d.5 OR [country] in ["c%d", "c%d"]`, lo, rnd.Intn(20), rnd.Intn(20))
+	case 3:
+		return fmt.Sprintf(`NOT ([age] < %d OR [age] > %d)`, lo, lo+10)
+	case 4:
+		return fmt.Sprintf(`[country] == "c%d" XOR [vip]`, rnd.Intn(20))
+	case 5:
+		return fmt.Sprintf(`%d <= [score] AND NOT [vip]`, lo)
+	case 6:
+		return fmt.Sprintf(`[age] + [tier] > %d`, lo)
+	}
+	return fmt.Sprintf(`[age] != %d AND [tier] == %d`, lo, rnd.Intn(10))
+}
+
+// randomArgs returns args with missing, mistyped and NaN values.
+func randomArgs(rnd *rand.Rand) map[string]interface{} {
+	args := map[string]interface{}{
+		"country": fmt.Sprintf("c%d", rnd.Intn(20)),
+		"age":     rnd.Intn(120),
+		"tier":    float64(rnd.Intn(10)),
+		"score":   rnd.Float64() * 100,
+		"vip":     rnd.Intn(2) == 0,
+	}
+	switch rnd.Intn(6) {
+	case 0:
+		delete(args, []string{"country", "age", "tier", "score", "vip"}[rnd.Intn(5)])
+	case 1:
+		args["score"] = math.NaN()
+	case 2:
+		args["age"] = math.NaN()
+	case 3:
+		args["age"] = "old"
+	}
+	return args
+}
+
+func newRandomRuleSets(t testing.TB, rnd *rand.Rand, n int) (naive, indexed *RuleSet) {
+	naive, indexed = NewRuleSet(Options{}), NewIndexedRuleSet(Options{})
+	for i := 0; i < n; i++ {
+		cond := randomRule(rnd)
+		expr, err := NewParser(strings.NewReader(cond)).Parse()
+		if err != nil {
+			t.Fatal(cond, err)
+		}
+		rule := Rule{Name: fmt.Sprintf("rule%d", i), Expr: expr, Priority: rnd.Intn(3)}
+		if err := naive.Add(rule); err != nil {
+			t.Fatal(err)
+		}
+		if err := indexed.Add(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return naive, indexed
+}
+
+func TestIndexedRuleSetMatchesNaive(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	naive, indexed := newRandomRuleSets(t, rnd, 500)
+
+	for i := 0; i < 300; i++ {
+		args := randomArgs(rnd)
+		for _, strategy := range []MatchStrategy{MatchAll, MatchFirst, MatchN(3)} {
+			want, _ := naive.Match(args, strategy)
+			got, _ := indexed.Match(args, strategy)
+			assert.Equal(t, want, got, "%v", args)
+		}
+
+		// Keep the index up to date.
+		if i%10 == 0 {
+			name := fmt.Sprintf("rule%d", rnd.Intn(500))
+			assert.Equal(t, naive.Remove(name), indexed.Remove(name))
+		}
+	}
+}
+
+func TestIndexedRuleSetCandidates(t *testing.T) {
+	s := NewIndexedRuleSet(Options{})
+	for name, cond := range map[string]string{
+		"eq":      `[a] == "x" AND [b] > 1`,
+		"in":      `[n] in [1, 2, 3]`,
+		"range":   `[n] > 5 AND [n] <= 10`,
+		"swapped": `10 < [n]`,
+		"flag":    `[b] > 1 AND NOT [f]`,
+		"or":      `[a] == "y" OR [n] >= 100`,
+		"any":     `[n] * 2 == 8`,
+	} {
+		expr, err := NewParser(strings.NewReader(cond)).Parse()
+		assert.Nil(t, err)
+		assert.Nil(t, s.Add(Rule{Name: name, Expr: expr}))
+	}
+
+	data := []struct {
+		args map[string]interface{}
+		want []string
+	}{
+		{map[string]interface{}{"a": "x", "n": 2}, []string{"any", "eq", "in"}},
+		{map[string]interface{}{"a": "y", "n": 10}, []string{"any", "or", "range"}},
+		{map[string]interface{}{"n": 11, "f": false}, []string{"any", "flag", "swapped"}},
+		{map[string]interface{}{"n": 100.0}, []string{"any", "or", "swapped"}},
+		{map[string]interface{}{"n": math.NaN()}, []string{"any", "or", "range", "swapped"}},
+		{map[string]interface{}{}, []string{"any"}},
+	}
+	for _, td := range data {
+		s.mu.Lock()
+		s.index.build()
+		s.mu.Unlock()
+
+		resolved := map[string]interface{}{}
+		for k, v := range td.args {
+			resolved[k] = v
+		}
+		var names []string
+		for _, r := range s.index.candidates(resolved) {
+			names = append(names, r.Name)
+		}
+		sort.Strings(names)
+		assert.Equal(t, td.want, names, "%v", td.args)
+	}
+}
+
+// benchmarkRule returns a condition on fields of which the number of
+// distinct values compared to grows with the number of rules.
+func benchmarkRule(rnd *rand.Rand, n int) string {
+	switch rnd.Intn(4) {
+	case 0:
+		return fmt.Sprintf(`[user] == "u%d" AND [amount] > %d`, rnd.Intn(n), rnd.Intn(1000))
+	case 1:
+		return fmt.Sprintf(`[sku] in ["s%d", "s%d", "s%d"] AND [country] == "c%d"`, rnd.Intn(n), rnd.Intn(n), rnd.Intn(n), rnd.Intn(20))
+	case 2:
+		lo := rnd.Intn(n)
+		return fmt.Sprintf(`[price] >= %d AND [price] < %d`, lo, lo+5)
+	}
+	return fmt.Sprintf(`[user] == "u%d" OR [sku] == "s%d"`, rnd.Intn(n), rnd.Intn(n))
+}
+
+func BenchmarkRuleSet(b *testing.B) {
+	for _, n := range []int{1000, 10000, 50000} {
+		rnd := rand.New(rand.NewSource(1))
+		naive, indexed := NewRuleSet(Options{}), NewIndexedRuleSet(Options{})
+		for i := 0; i < n; i++ {
+			expr, err := NewParser(strings.NewReader(benchmarkRule(rnd, n))).Parse()
+			if err != nil {
+				b.Fatal(err)
+			}
+			rule := Rule{Name: fmt.Sprintf("rule%d", i), Expr: expr}
+			naive.Add(rule)
+			indexed.Add(rule)
+		}
+		args := make([]map[string]interface{}, 64)
+		for i := range args {
+			args[i] = map[string]interface{}{
+				"user":    fmt.Sprintf("u%d", rnd.Intn(n)),
+				"sku":     fmt.Sprintf("s%d", rnd.Intn(n)),
+				"country": fmt.Sprintf("c%d", rnd.Intn(20)),
+				"amount":  rnd.Intn(1000),
+				"price":   rnd.Float64() * float64(n),
+			}
+		}
+
+		b.Run(fmt.Sprintf("naive/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				naive.Match(args[i%len(args)], MatchAll)
+			}
+		})
+		b.Run(fmt.Sprintf("indexed/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				indexed.Match(args[i%len(args)], MatchAll)
+			}
+		})
+	}
+}
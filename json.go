@@ -0,0 +1,438 @@
+package conditions
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// JSONVersion is the version of the JSON encoding of expressions written by
+// MarshalExpr. UnmarshalExpr rejects documents of other versions.
+//
+// A document is {"version": 1, "expr": node} and every node is an object
+// tagged by its "type":
+//
+//	binary   {"type": "binary", "op": "AND", "lhs": node, "rhs": node}
+//	unary    {"type": "unary", "op": "NOT", "expr": node}
+//	paren    {"type": "paren", "expr": node}
+//	call     {"type": "call", "name": "lower", "args": [node, ...]}
+//	var      {"type": "var", "name": "a.b", "path": ["a", "b"]}
+//	number   {"type": "number", "value": 1.5}
+//	string   {"type": "string", "value": "abc"}
+//	boolean  {"type": "boolean", "value": true}
+//	strings  {"type": "strings", "value": ["a", "b"]}
+//	numbers  {"type": "numbers", "value": [1, 2]}
+//	regex    {"type": "regex", "pattern": "^a", "flags": "i"}
+//	time     {"type": "time", "value": "2017-09-13T12:00:00Z"}
+//	duration {"type": "duration", "value": "1h30m"}
+//
+// Operators are written as in the conditions, e.g. "==", "NOT IN", "+" or
+// "IS NULL".
+// The path of a variable is optional, it defaults to the name split on
+// dots. The arguments of a call are optional when there are none.
+const JSONVersion = 1
+
+// jsonDocument is the versioned envelope of an encoded expression.
+type jsonDocument struct {
+	Version int             `json:"version"`
+	Expr    json.RawMessage `json:"expr"`
+}
+
+// jsonNode is the encoded form of every node.
+type jsonNode struct {
+	Type    string      `json:"type"`
+	Op      string      `json:"op,omitempty"`
+	LHS     Expr        `json:"lhs,omitempty"`
+	RHS     Expr        `json:"rhs,omitempty"`
+	Expr    Expr        `json:"expr,omitempty"`
+	Name    string      `json:"name,omitempty"`
+	Path    []string    `json:"path,omitempty"`
+	Args    []Expr      `json:"args,omitempty"`
+	Value   interface{} `json:"value,omitempty"`
+	Pattern string      `json:"pattern,omitempty"`
+	Flags   string      `json:"flags,omitempty"`
+}
+
+// rawNode is the decoded form of every node, children are decoded
+// according to the type.
+type rawNode struct {
+	Type    string            `json:"type"`
+	Op      string            `json:"op"`
+	LHS     json.RawMessage   `json:"lhs"`
+	RHS     json.RawMessage   `json:"rhs"`
+	Expr    json.RawMessage   `json:"expr"`
+	Name    string            `json:"name"`
+	Path    []string          `json:"path"`
+	Args    []json.RawMessage `json:"args"`
+	Value   json.RawMessage   `json:"value"`
+	Pattern string            `json:"pattern"`
+	Flags   string            `json:"flags"`
+}
+
+// MarshalExpr returns the versioned JSON encoding of an expression.
+func MarshalExpr(expr Expr) ([]byte, error) {
+	if expr == nil {
+		return nil, fmt.Errorf("Provided expression is nil")
+	}
+	node, err := json.Marshal(expr)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonDocument{Version: JSONVersion, Expr: node})
+}
+
+// UnmarshalExpr decodes and validates an expression encoded by
+// MarshalExpr. Calls are resolved in funcs and checked against the
+// function signatures, as done by the parser; they are left unresolved
+// when funcs is nil.
+func UnmarshalExpr(data []byte, funcs *FunctionRegistry) (Expr, error) {
+	return UnmarshalExprWithLimits(data, funcs, RegexLimits{})
+}
+
+// UnmarshalExprWithLimits decodes an expression like UnmarshalExpr and
+// checks its regular expressions against the limits, as the parser does.
+func UnmarshalExprWithLimits(data []byte, funcs *FunctionRegistry, limits RegexLimits) (Expr, error) {
+	var doc jsonDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Version != JSONVersion {
+		return nil, fmt.Errorf("Unsupported JSON version %d, expected %d", doc.Version, JSONVersion)
+	}
+	return (&jsonDecoder{funcs: funcs, limits: limits}).decode(doc.Expr, "$.expr")
+}
+
+// MarshalJSON returns the JSON encoding of the node.
+func (r *VarRef) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{Type: "var", Name: r.Val, Path: r.Path})
+}
+
+// MarshalJSON returns the JSON encoding of the node.
+func (l *NumberLiteral) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{Type: "number", Value: l.Val})
+}
+
+// MarshalJSON returns the JSON encoding of the node.
+func (l *StringLiteral) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{Type: "string", Value: l.Val})
+}
+
+// MarshalJSON returns the JSON encoding of the node.
+func (l *RegexLiteral) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{Type: "regex", Pattern: l.Pattern, Flags: l.Flags})
+}
+
+// MarshalJSON returns the JSON encoding of the node.
+func (l *BooleanLiteral) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{Type: "boolean", Value: l.Val})
+}
+
+// MarshalJSON returns the JSON encoding of the node.
+func (l *SliceStringLiteral) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{Type: "strings", Value: l.Val})
+}
+
+// MarshalJSON returns the JSON encoding of the node.
+func (l *SliceNumberLiteral) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{Type: "numbers", Value: l.Val})
+}
+
+// MarshalJSON returns the JSON encoding of the node.
+func (l *TimeLiteral) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{Type: "time", Value: l.Val.Format(time.RFC3339Nano)})
+}
+
+// MarshalJSON returns the JSON encoding of the node.
+func (l *DurationLiteral) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{Type: "duration", Value: FormatDuration(l.Val)})
+}
+
+// MarshalJSON returns the JSON encoding of the node.
+func (e *BinaryExpr) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{Type: "binary", Op: e.Op.String(), LHS: e.LHS, RHS: e.RHS})
+}
+
+// MarshalJSON returns the JSON encoding of the node.
+func (e *UnaryExpr) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{Type: "unary", Op: e.Op.String(), Expr: e.Expr})
+}
+
+// MarshalJSON returns the JSON encoding of the node.
+func (e *CallExpr) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{Type: "call", Name: e.Name, Args: e.Arguments})
+}
+
+// MarshalJSON returns the JSON encoding of the node.
+func (e *ParenExpr) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{Type: "paren", Expr: e.Expr})
+}
+
+// MarshalJSON reports an error, bad expressions cannot be encoded.
+func (e *BadExpr) MarshalJSON() ([]byte, error) {
+	return nil, fmt.Errorf("Cannot encode an expression with syntax errors")
+}
+
+// UnmarshalJSON decodes and validates the node.
+func (r *VarRef) UnmarshalJSON(data []byte) error { return unmarshalNode(data, r) }
+
+// UnmarshalJSON decodes and validates the node.
+func (l *NumberLiteral) UnmarshalJSON(data []byte) error { return unmarshalNode(data, l) }
+
+// UnmarshalJSON decodes and validates the node.
+func (l *StringLiteral) UnmarshalJSON(data []byte) error { return unmarshalNode(data, l) }
+
+// UnmarshalJSON decodes and validates the node.
+func (l *RegexLiteral) UnmarshalJSON(data []byte) error { return unmarshalNode(data, l) }
+
+// UnmarshalJSON decodes and validates the node.
+func (l *BooleanLiteral) UnmarshalJSON(data []byte) error { return unmarshalNode(data, l) }
+
+// UnmarshalJSON decodes and validates the node.
+func (l *SliceStringLiteral) UnmarshalJSON(data []byte) error { return unmarshalNode(data, l) }
+
+// UnmarshalJSON decodes and validates the node.
+func (l *SliceNumberLiteral) UnmarshalJSON(data []byte) error { return unmarshalNode(data, l) }
+
+// UnmarshalJSON decodes and validates the node.
+func (l *TimeLiteral) UnmarshalJSON(data []byte) error { return unmarshalNode(data, l) }
+
+// UnmarshalJSON decodes and validates the node.
+func (l *DurationLiteral) UnmarshalJSON(data []byte) error { return unmarshalNode(data, l) }
+
+// UnmarshalJSON decodes and validates the node, calls are left unresolved.
+func (e *BinaryExpr) UnmarshalJSON(data []byte) error { return unmarshalNode(data, e) }
+
+// UnmarshalJSON decodes and validates the node, calls are left unresolved.
+func (e *UnaryExpr) UnmarshalJSON(data []byte) error { return unmarshalNode(data, e) }
+
+// UnmarshalJSON decodes and validates the node, calls are left unresolved.
+func (e *CallExpr) UnmarshalJSON(data []byte) error { return unmarshalNode(data, e) }
+
+// UnmarshalJSON decodes and validates the node, calls are left unresolved.
+func (e *ParenExpr) UnmarshalJSON(data []byte) error { return unmarshalNode(data, e) }
+
+// unmarshalNode decodes a node into dst, which must be of the same type.
+func unmarshalNode(data []byte, dst Expr) error {
+	expr, err := (&jsonDecoder{}).decode(data, "$")
+	if err != nil {
+		return err
+	}
+	if reflect.TypeOf(expr) != reflect.TypeOf(dst) {
+		return fmt.Errorf("Invalid expression at $: cannot decode %T into %T", expr, dst)
+	}
+	reflect.ValueOf(dst).Elem().Set(reflect.ValueOf(expr).Elem())
+	return nil
+}
+
+// jsonOperators maps the encoded operators to their tokens.
+var jsonOperators = func() map[string]Token {
+	ops := map[string]Token{}
+	for tok := operatorBegin + 1; tok < operatorEnd; tok++ {
+		ops[tok.String()] = tok
+	}
+	return ops
+}()
+
+// jsonUnaryOperators maps the encoded unary operators to their tokens.
+var jsonUnaryOperators = map[string]Token{
+	NOT.String():       NOT,
+	EXISTS.String():    EXISTS,
+	ISNULL.String():    ISNULL,
+	ISNOTNULL.String(): ISNOTNULL,
+}
+
+// jsonDecoder decodes nodes, reporting errors with the JSON path of the
+// invalid node.
+type jsonDecoder struct {
+	funcs  *FunctionRegistry
+	limits RegexLimits
+}
+
+func (d *jsonDecoder) errorf(path string, format string, args ...interface{}) error {
+	return fmt.Errorf("Invalid expression at %s: %s", path, fmt.Sprintf(format, args...))
+}
+
+// decode decodes the node at path.
+func (d *jsonDecoder) decode(data json.RawMessage, path string) (Expr, error) {
+	if isNull(data) {
+		return nil, d.errorf(path, "missing expression")
+	}
+	var n rawNode
+	if err := json.Unmarshal(data, &n); err != nil {
+		return nil, d.errorf(path, "%s", err)
+	}
+
+	switch n.Type {
+	case "binary":
+		op, ok := jsonOperators[n.Op]
+		if !ok {
+			return nil, d.errorf(path, "unknown binary operator %q", n.Op)
+		}
+		lhs, err := d.decode(n.LHS, path+".lhs")
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := d.decode(n.RHS, path+".rhs")
+		if err != nil {
+			return nil, err
+		}
+		if err := d.limits.checkPattern(op, rhs); err != nil {
+			return nil, d.errorf(path+".rhs", "%s", err)
+		}
+		return &BinaryExpr{Op: op, LHS: lhs, RHS: rhs}, nil
+
+	case "unary":
+		op, ok := jsonUnaryOperators[n.Op]
+		if !ok {
+			return nil, d.errorf(path, "unknown unary operator %q", n.Op)
+		}
+		expr, err := d.decode(n.Expr, path+".expr")
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := expr.(*VarRef); isPresence(op) && !ok {
+			return nil, d.errorf(path+".expr", "%s requires a variable", op)
+		}
+		return &UnaryExpr{Op: op, Expr: expr}, nil
+
+	case "paren":
+		expr, err := d.decode(n.Expr, path+".expr")
+		if err != nil {
+			return nil, err
+		}
+		return &ParenExpr{Expr: expr}, nil
+
+	case "call":
+		return d.decodeCall(&n, path)
+
+	case "var":
+		if n.Name == "" {
+			return nil, d.errorf(path, "missing variable name")
+		}
+		if n.Path == nil {
+			n.Path = strings.Split(n.Name, ".")
+		} else if strings.Join(n.Path, ".") != n.Name {
+			return nil, d.errorf(path, "path %q does not match the name %q", n.Path, n.Name)
+		}
+		return &VarRef{Val: n.Name, Path: n.Path}, nil
+
+	case "regex":
+		re, err := NewRegexLiteral(n.Pattern, n.Flags, d.limits)
+		if err != nil {
+			return nil, d.errorf(path, "%s", err)
+		}
+		return re, nil
+
+	case "number", "string", "boolean", "strings", "numbers", "time", "duration":
+		return d.decodeLiteral(&n, path)
+
+	case "":
+		return nil, d.errorf(path, "missing type")
+	}
+	return nil, d.errorf(path, "unknown type %q", n.Type)
+}
+
+// decodeCall decodes a call and resolves the function.
+func (d *jsonDecoder) decodeCall(n *rawNode, path string) (Expr, error) {
+	if n.Name == "" {
+		return nil, d.errorf(path, "missing function name")
+	}
+	call := &CallExpr{Name: n.Name, Arguments: []Expr{}}
+	for i, raw := range n.Args {
+		arg, err := d.decode(raw, fmt.Sprintf("%s.args[%d]", path, i))
+		if err != nil {
+			return nil, err
+		}
+		call.Arguments = append(call.Arguments, arg)
+	}
+
+	if d.funcs != nil {
+		f, ok := d.funcs.Lookup(n.Name)
+		if !ok {
+			return nil, d.errorf(path, "unknown function %s", n.Name)
+		}
+		if err := f.checkArgs(call.Arguments); err != nil {
+			return nil, d.errorf(path, "%s", err)
+		}
+		call.Func = f
+	}
+	return call, nil
+}
+
+// decodeLiteral decodes the value of a literal.
+func (d *jsonDecoder) decodeLiteral(n *rawNode, path string) (Expr, error) {
+	if isNull(n.Value) {
+		return nil, d.errorf(path, "missing value")
+	}
+
+	var (
+		lit Expr
+		err error
+	)
+	switch n.Type {
+	case "number":
+		l := &NumberLiteral{}
+		lit = l
+		err = d.value(n, path, &l.Val)
+	case "string":
+		l := &StringLiteral{}
+		lit = l
+		err = d.value(n, path, &l.Val)
+	case "boolean":
+		l := &BooleanLiteral{}
+		lit = l
+		err = d.value(n, path, &l.Val)
+	case "strings":
+		l := &SliceStringLiteral{}
+		lit = l
+		if err = d.value(n, path, &l.Val); err == nil && len(l.Val) == 0 {
+			err = d.errorf(path, "empty slice")
+		}
+	case "numbers":
+		l := &SliceNumberLiteral{}
+		lit = l
+		if err = d.value(n, path, &l.Val); err == nil && len(l.Val) == 0 {
+			err = d.errorf(path, "empty slice")
+		}
+	}
+	if lit != nil {
+		if err != nil {
+			return nil, err
+		}
+		return lit, nil
+	}
+
+	// Times and durations are encoded as in the conditions.
+	var s string
+	if err := d.value(n, path, &s); err != nil {
+		return nil, err
+	}
+	if n.Type == "time" {
+		t, err := ParseTime(s)
+		if err != nil {
+			return nil, d.errorf(path, "%s", err)
+		}
+		return &TimeLiteral{Val: t}, nil
+	}
+	v, err := ParseDuration(s)
+	if err != nil {
+		return nil, d.errorf(path, "%s", err)
+	}
+	return &DurationLiteral{Val: v}, nil
+}
+
+// value decodes the value of a literal into v.
+func (d *jsonDecoder) value(n *rawNode, path string, v interface{}) error {
+	if err := json.Unmarshal(n.Value, v); err != nil {
+		return d.errorf(path, "invalid %s value %s", n.Type, n.Value)
+	}
+	return nil
+}
+
+// isNull reports whether a JSON value is missing or null.
+func isNull(data json.RawMessage) bool {
+	return len(data) == 0 || bytes.Equal(bytes.TrimSpace(data), []byte("null"))
+}
@@ -0,0 +1,125 @@
+package conditions
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalExpr(t *testing.T) {
+	expr, err := NewParser(strings.NewReader(`[a][b] == 1 AND NOT ([c] in ["x"] OR [d] =~ /^e/i)`)).Parse()
+	if !assert.Nil(t, err) {
+		return
+	}
+	data, err := MarshalExpr(expr)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"version":1,"expr":{"type":"binary","op":"AND",`+
+		`"lhs":{"type":"binary","op":"==","lhs":{"type":"var","name":"a.b","path":["a","b"]},"rhs":{"type":"number","value":1}},`+
+		`"rhs":{"type":"unary","op":"NOT","expr":{"type":"paren","expr":{"type":"binary","op":"OR",`+
+		`"lhs":{"type":"binary","op":"IN","lhs":{"type":"var","name":"c","path":["c"]},"rhs":{"type":"strings","value":["x"]}},`+
+		`"rhs":{"type":"binary","op":"=~","lhs":{"type":"var","name":"d","path":["d"]},"rhs":{"type":"regex","pattern":"^e","flags":"i"}}}}}}}`,
+		string(data))
+}
+
+func TestMarshalExprRoundTrip(t *testing.T) {
+	conds := []string{
+		`[a] == 0 AND [b] == "" AND [c] == false`,
+		`[a] not in [1, -2.5] XOR [b] NAND [c]`,
+		`[a] - [b] * 2 % 3 / 4 + 1 >= 0`,
+		`[now] - [then] > 1h30m AND [then] < TIME "2017-09-13T12:00:00.5+02:00"`,
+		`[a] > -5m AND [b] < -1500ms`,
+		`lower([s]) !~ "x" OR NOT !true`,
+		`EXISTS [a][b] AND [c] IS NULL OR [d] IS NOT NULL`,
+	}
+	for _, td := range validTestData {
+		conds = append(conds, td.cond)
+	}
+
+	funcs := NewFunctionRegistry()
+	assert.Nil(t, funcs.Register("lower", strings.ToLower))
+	for _, cond := range conds {
+		p := NewParser(strings.NewReader(cond))
+		p.SetFunctions(funcs)
+		expr, err := p.Parse()
+		if !assert.Nil(t, err, cond) {
+			continue
+		}
+		data, err := MarshalExpr(expr)
+		if !assert.Nil(t, err, cond) {
+			continue
+		}
+		decoded, err := UnmarshalExpr(data, funcs)
+		if !assert.Nil(t, err, cond) {
+			continue
+		}
+		assert.True(t, Equal(expr, decoded), cond)
+		assert.Equal(t, Format(expr), Format(decoded), cond)
+	}
+}
+
+func TestUnmarshalExprErrors(t *testing.T) {
+	data := []struct {
+		json string
+		err  string
+	}{
+		{`{"version":2,"expr":{"type":"boolean","value":true}}`, "Unsupported JSON version 2"},
+		{`{"expr":{"type":"boolean","value":true}}`, "Unsupported JSON version 0"},
+		{`{"version":1}`, "at $.expr: missing expression"},
+		{`{"version":1,"expr":{"value":true}}`, "at $.expr: missing type"},
+		{`{"version":1,"expr":{"type":"ternary"}}`, `at $.expr: unknown type "ternary"`},
+		{`{"version":1,"expr":{"type":"binary","op":"<>","lhs":{"type":"number","value":1},"rhs":{"type":"number","value":2}}}`, `unknown binary operator "<>"`},
+		{`{"version":1,"expr":{"type":"binary","op":"AND","lhs":{"type":"boolean","value":true}}}`, "at $.expr.rhs: missing expression"},
+		{`{"version":1,"expr":{"type":"binary","op":"AND","rhs":{"type":"boolean","value":true},"lhs":null}}`, "at $.expr.lhs: missing expression"},
+		{`{"version":1,"expr":{"type":"unary","op":"-","expr":{"type":"number","value":1}}}`, `unknown unary operator "-"`},
+		{`{"version":1,"expr":{"type":"unary","op":"NOT"}}`, "at $.expr.expr: missing expression"},
+		{`{"version":1,"expr":{"type":"unary","op":"EXISTS","expr":{"type":"number","value":1}}}`, "at $.expr.expr: EXISTS requires a variable"},
+		{`{"version":1,"expr":{"type":"number","value":"1"}}`, `invalid number value "1"`},
+		{`{"version":1,"expr":{"type":"boolean"}}`, "missing value"},
+		{`{"version":1,"expr":{"type":"strings","value":[]}}`, "empty slice"},
+		{`{"version":1,"expr":{"type":"numbers","value":["a"]}}`, "invalid numbers value"},
+		{`{"version":1,"expr":{"type":"time","value":"yesterday"}}`, "Invalid time"},
+		{`{"version":1,"expr":{"type":"duration","value":"5"}}`, "Invalid duration"},
+		{`{"version":1,"expr":{"type":"regex","pattern":"(a"}}`, "Invalid regular expression"},
+		{`{"version":1,"expr":{"type":"regex","pattern":"a","flags":"x"}}`, "Unknown regular expression flag x"},
+		{`{"version":1,"expr":{"type":"var"}}`, "missing variable name"},
+		{`{"version":1,"expr":{"type":"var","name":"a.b","path":["a","c"]}}`, "does not match the name"},
+		{`{"version":1,"expr":{"type":"call","name":"upper"}}`, "unknown function upper"},
+		{`{"version":1,"expr":{"type":"call","name":"lower"}}`, "lower expects 1 arguments"},
+		{`{"version":1,"expr":{"type":"call","name":"lower","args":[{"type":"number"}]}}`, "at $.expr.args[0]: missing value"},
+		{`{"version":1,"expr":[]}`, "at $.expr: json"},
+	}
+
+	funcs := NewFunctionRegistry()
+	assert.Nil(t, funcs.Register("lower", strings.ToLower))
+	for _, td := range data {
+		expr, err := UnmarshalExpr([]byte(td.json), funcs)
+		assert.Nil(t, expr, td.json)
+		if assert.NotNil(t, err, td.json) {
+			assert.Contains(t, err.Error(), td.err, td.json)
+		}
+	}
+}
+
+func TestNodeJSON(t *testing.T) {
+	var bin BinaryExpr
+	err := json.Unmarshal([]byte(`{"type":"binary","op":"NOT IN","lhs":{"type":"var","name":"a"},"rhs":{"type":"numbers","value":[1,2]}}`), &bin)
+	if assert.Nil(t, err) {
+		assert.Equal(t, `[a] NOT IN [1, 2]`, Format(&bin))
+	}
+
+	var num NumberLiteral
+	assert.NotNil(t, json.Unmarshal([]byte(`{"type":"string","value":"1"}`), &num))
+
+	// Nodes are encoded within other documents.
+	doc := struct {
+		Rule Expr `json:"rule"`
+	}{&UnaryExpr{Op: NOT, Expr: &VarRef{Val: "a"}}}
+	data, err := json.Marshal(doc)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"rule":{"type":"unary","op":"NOT","expr":{"type":"var","name":"a"}}}`, string(data))
+
+	_, err = MarshalExpr(&BinaryExpr{Op: AND, LHS: &BooleanLiteral{Val: true}, RHS: &BadExpr{}})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,115 @@
+package conditions
+
+import "fmt"
+
+var (
+	nullExpr = &nullLiteral{}
+)
+
+// isNullLiteral returns true for the null value.
+func isNullLiteral(e Expr) bool {
+	_, ok := e.(*nullLiteral)
+	return ok
+}
+
+// isPresence returns true for the operators testing whether a variable is
+// set: EXISTS, IS NULL and IS NOT NULL.
+func isPresence(op Token) bool {
+	return op == EXISTS || op == ISNULL || op == ISNOTNULL
+}
+
+// presence applies a presence operator to the result of a lookup. A
+// variable set to nil exists but is null.
+func presence(op Token, v interface{}, ok bool) bool {
+	switch op {
+	case EXISTS:
+		return ok
+	case ISNULL:
+		return !ok || v == nil
+	}
+	return ok && v != nil
+}
+
+// presenceRef returns the variable reference tested by a presence operator.
+func presenceRef(n *UnaryExpr) (*VarRef, error) {
+	ref, ok := n.Expr.(*VarRef)
+	if !ok {
+		return nil, fmt.Errorf("%s requires a variable reference, got %s", n.Op, n.Expr)
+	}
+	return ref, nil
+}
+
+// evaluatePresence tests the variable of a presence operator, whatever the
+// missing mode is.
+func evaluatePresence(n *UnaryExpr, args resolver) (Expr, error) {
+	ref, err := presenceRef(n)
+	if err != nil {
+		return falseExpr, err
+	}
+	v, ok := args.resolve(ref)
+	return &BooleanLiteral{Val: presence(n.Op, v, ok)}, nil
+}
+
+// isArithmetic returns true for the arithmetic operators.
+func isArithmetic(op Token) bool {
+	return op == ADD || op == SUB || op == MUL || op == DIV || op == MOD
+}
+
+// applyNull applies a binary operator to operands of which at least one is
+// null, see MissingMode.
+func applyNull(op Token, l, r Expr, mode MissingMode) (Expr, error) {
+	lnull, rnull := isNullLiteral(l), isNullLiteral(r)
+	switch {
+	case isLogical(op):
+		if lnull {
+			l = falseExpr
+		}
+		if rnull {
+			r = falseExpr
+		}
+		return applyOperator(op, l, r)
+	case isArithmetic(op):
+		return nullExpr, nil
+	}
+	return &BooleanLiteral{Val: nullComparison(op, lnull && rnull, mode)}, nil
+}
+
+// nullComparison returns the result of a comparison of null operands.
+func nullComparison(op Token, bothNull bool, mode MissingMode) bool {
+	if mode == MissingFalse {
+		return false
+	}
+	switch op {
+	case EQ:
+		return bothNull
+	case NEQ:
+		return !bothNull
+	case NOTIN, NEREG:
+		return true
+	}
+	return false
+}
+
+// nullOperator wraps a compiled binary operator to apply it to null
+// operands as applyNull does.
+func nullOperator(op Token, fn binaryFunc, mode MissingMode) binaryFunc {
+	logical, arithmetic := isLogical(op), isArithmetic(op)
+	return func(l, r value) (value, error) {
+		lnull, rnull := l.kind == kindNull, r.kind == kindNull
+		switch {
+		case !lnull && !rnull:
+			return fn(l, r)
+		case logical:
+			if lnull {
+				l = boolValue(false)
+			}
+			if rnull {
+				r = boolValue(false)
+			}
+			return fn(l, r)
+		case arithmetic:
+			return value{kind: kindNull}, nil
+		}
+		return boolValue(nullComparison(op, lnull && rnull, mode)), nil
+	}
+}
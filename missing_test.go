@@ -0,0 +1,136 @@
+package conditions
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMissingModes(t *testing.T) {
+	args := map[string]interface{}{
+		"a":    1,
+		"s":    "x",
+		"nil":  nil,
+		"flag": true,
+		"obj":  map[string]interface{}{"b": 2},
+	}
+	// Results with MissingNull and MissingFalse, MissingError gives the
+	// result with MissingNull unless err is set.
+	data := []struct {
+		cond      string
+		whenNull  bool
+		whenFalse bool
+		err       bool
+	}{
+		{`[a] == 1`, true, true, false},
+		{`[x] == 1`, false, false, true},
+		{`[x] != 1`, true, false, true},
+		{`[x] == [y]`, true, false, true},
+		{`[x] != [nil]`, false, false, true},
+		{`[x] > 1 OR [x] <= 1`, false, false, true},
+		{`[x] IN [1, 2]`, false, false, true},
+		{`[x] NOT IN [1, 2]`, true, false, true},
+		{`[s] IN [list]`, false, false, true},
+		{`[x] =~ /a/`, false, false, true},
+		{`[x] !~ /a/`, true, false, true},
+		{`[s] =~ [pattern]`, false, false, true},
+		{`[x] + 1 == 1`, false, false, true},
+		{`[x] + 1 != 1`, true, false, true},
+		{`[x]`, false, false, true},
+		{`NOT [x]`, true, true, true},
+		{`[x] OR [flag]`, true, true, true},
+		{`[x] AND [flag]`, false, false, true},
+		{`[x] XOR [flag]`, true, true, true},
+		{`[x] NAND [flag]`, true, true, true},
+		{`[nil] == 1`, false, false, true},
+		{`[obj][c] == 1`, false, false, true},
+
+		// Presence is tested whatever the mode.
+		{`EXISTS [a]`, true, true, false},
+		{`EXISTS [x]`, false, false, false},
+		{`EXISTS [nil]`, true, true, false},
+		{`EXISTS [obj][b] AND NOT EXISTS [obj][c]`, true, true, false},
+		{`[a] IS NULL`, false, false, false},
+		{`[x] IS NULL`, true, true, false},
+		{`[nil] IS NULL`, true, true, false},
+		{`[a] IS NOT NULL AND [x] IS NOT NULL`, false, false, false},
+		{`[x] IS NULL OR [x] > 1`, true, true, false},
+		{`NOT EXISTS [x] OR [x] > 1`, true, true, false},
+	}
+
+	for _, td := range data {
+		expr, err := NewParser(strings.NewReader(td.cond)).Parse()
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+		for mode, want := range map[MissingMode]bool{MissingNull: td.whenNull, MissingFalse: td.whenFalse, MissingError: td.whenNull} {
+			opts := Options{Missing: mode}
+			got, err := EvaluateWithOptions(expr, args, opts)
+			prg, cerr := CompileWithOptions(expr, opts)
+			if !assert.Nil(t, cerr, td.cond) {
+				continue
+			}
+			pgot, perr := prg.Evaluate(args)
+			if mode == MissingError && td.err {
+				assert.NotNil(t, err, td.cond)
+				assert.NotNil(t, perr, td.cond)
+				continue
+			}
+			assert.Nil(t, err, "%s %d", td.cond, mode)
+			assert.Equal(t, want, got, "%s %d", td.cond, mode)
+			assert.Nil(t, perr, "%s %d", td.cond, mode)
+			assert.Equal(t, want, pgot, "%s %d", td.cond, mode)
+		}
+	}
+}
+
+func TestMissingCall(t *testing.T) {
+	p := NewParser(strings.NewReader(`isset([x]) OR lower([x]) == ""`))
+	p.SetFunctions(testFunctions(t))
+	expr, err := p.Parse()
+	if !assert.Nil(t, err) {
+		return
+	}
+	// Null is passed as nil to untyped parameters only.
+	for _, opts := range []Options{{Missing: MissingNull}, {Missing: MissingFalse}} {
+		_, err = EvaluateWithOptions(expr, map[string]interface{}{}, opts)
+		assert.Contains(t, err.Error(), "Function lower expects string")
+		r, err := EvaluateWithOptions(expr, map[string]interface{}{"x": "a"}, opts)
+		assert.Nil(t, err)
+		assert.True(t, r)
+	}
+}
+
+func TestMissingRuleSet(t *testing.T) {
+	rules := []string{
+		`[a] == 1`,
+		`NOT ([a] > 5)`,
+		`[a] > 5 NAND [b] == "x"`,
+		`[a] IS NULL AND [b] == "x"`,
+		`NOT [flag]`,
+		`EXISTS [b] OR [a] < 0`,
+	}
+	for _, mode := range []MissingMode{MissingNull, MissingFalse} {
+		naive, indexed := NewRuleSet(Options{Missing: mode}), NewIndexedRuleSet(Options{Missing: mode})
+		for i, cond := range rules {
+			expr, err := NewParser(strings.NewReader(cond)).Parse()
+			assert.Nil(t, err, cond)
+			rule := Rule{Name: cond, Expr: expr, Priority: -i}
+			assert.Nil(t, naive.Add(rule))
+			assert.Nil(t, indexed.Add(rule))
+		}
+		for _, args := range []map[string]interface{}{
+			{},
+			{"a": 1},
+			{"a": 7, "b": "x"},
+			{"b": "x", "flag": false},
+		} {
+			want, err := naive.Match(args, MatchAll)
+			assert.Nil(t, err)
+			got, err := indexed.Match(args, MatchAll)
+			assert.Nil(t, err)
+			assert.Equal(t, want, got, "%v %d", args, mode)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package conditions
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultMaxClauses is the maximum number of clauses of the normal forms
+// returned by ToDNF and ToCNF.
+const DefaultMaxClauses = 1000
+
+// ErrTooManyClauses is returned when a normal form exceeds the clause
+// limit.
+var ErrTooManyClauses = errors.New("Normal form exceeds the clause limit")
+
+// negated maps comparison and null test operators to the operator of their
+// negation.
+var negated = map[Token]Token{
+	EQ:        NEQ,
+	NEQ:       EQ,
+	GT:        LTE,
+	GTE:       LT,
+	LT:        GTE,
+	LTE:       GT,
+	IN:        NOTIN,
+	NOTIN:     IN,
+	EREG:      NEREG,
+	NEREG:     EREG,
+	ISNULL:    ISNOTNULL,
+	ISNOTNULL: ISNULL,
+}
+
+// ToDNF returns the disjunctive normal form of the expression, an OR of
+// clauses which are an AND of comparisons, boolean operands or their
+// negations. See ToDNFWithLimit.
+func ToDNF(expr Expr) (Expr, error) {
+	return ToDNFWithLimit(expr, DefaultMaxClauses)
+}
+
+// ToDNFWithLimit returns the disjunctive normal form of the expression or
+// ErrTooManyClauses if it has more than maxClauses clauses, 0 for no limit.
+//
+// Negations are pushed down to the operands, negated comparisons are
+// replaced by the opposite ones (`NOT ([a] < 1)` is `[a] >= 1`, which differ
+// for NaN and for null with MissingNull or MissingFalse), NAND and XOR are
+// expressed with AND, OR and NOT.
+func ToDNFWithLimit(expr Expr, maxClauses int) (Expr, error) {
+	return normalForm(expr, OR, maxClauses)
+}
+
+// ToCNF returns the conjunctive normal form of the expression, an AND of
+// clauses which are an OR of comparisons, boolean operands or their
+// negations. See ToCNFWithLimit.
+func ToCNF(expr Expr) (Expr, error) {
+	return ToCNFWithLimit(expr, DefaultMaxClauses)
+}
+
+// ToCNFWithLimit returns the conjunctive normal form of the expression or
+// ErrTooManyClauses if it has more than maxClauses clauses, 0 for no limit.
+// Negations are handled as by ToDNFWithLimit.
+func ToCNFWithLimit(expr Expr, maxClauses int) (Expr, error) {
+	return normalForm(expr, AND, maxClauses)
+}
+
+// normalForm returns the clauses of expr joined by the outer operator.
+func normalForm(expr Expr, outer Token, maxClauses int) (Expr, error) {
+	clauses, err := normalClauses(expr, outer, maxClauses)
+	if err != nil {
+		return nil, err
+	}
+	inner := dual(outer)
+	var result Expr
+	for _, clause := range clauses {
+		var c Expr
+		for _, lit := range clause {
+			c = join(inner, c, lit)
+		}
+		result = join(outer, result, c)
+	}
+	return result, nil
+}
+
+// normalClauses returns the clauses of the normal form of expr, the
+// literals of a clause are joined by the dual of the outer operator.
+func normalClauses(expr Expr, outer Token, maxClauses int) ([][]Expr, error) {
+	if expr == nil {
+		return nil, fmt.Errorf("Provided expression is nil")
+	}
+	return distribute(negationNormal(expr, false), outer, maxClauses)
+}
+
+// negationNormal returns expr, negated if negate is set, using only AND
+// and OR of literals: comparisons, operands and negated operands.
+func negationNormal(expr Expr, negate bool) Expr {
+	switch n := unparen(expr).(type) {
+	case *UnaryExpr:
+		switch {
+		case n.Op == NOT:
+			return negationNormal(n.Expr, !negate)
+		case negate && (n.Op == ISNULL || n.Op == ISNOTNULL):
+			return &UnaryExpr{Op: negated[n.Op], Expr: n.Expr}
+		case !negate:
+			return n
+		}
+	case *BooleanLiteral:
+		if negate {
+			return &BooleanLiteral{Val: !n.Val}
+		}
+		return n
+	case *BinaryExpr:
+		switch n.Op {
+		case AND, OR:
+			op := n.Op
+			if negate {
+				op = dual(op)
+			}
+			return &BinaryExpr{Op: op, LHS: negationNormal(n.LHS, negate), RHS: negationNormal(n.RHS, negate)}
+		case NAND:
+			// a NAND b is NOT a OR NOT b.
+			return negationNormal(&BinaryExpr{Op: AND, LHS: n.LHS, RHS: n.RHS}, !negate)
+		case XOR:
+			// a XOR b is a AND NOT b OR NOT a AND b, its negation
+			// a AND b OR NOT a AND NOT b.
+			return &BinaryExpr{
+				Op:  OR,
+				LHS: &BinaryExpr{Op: AND, LHS: negationNormal(n.LHS, false), RHS: negationNormal(n.RHS, !negate)},
+				RHS: &BinaryExpr{Op: AND, LHS: negationNormal(n.LHS, true), RHS: negationNormal(n.RHS, negate)},
+			}
+		}
+		if op, ok := negated[n.Op]; ok && negate {
+			return &BinaryExpr{Op: op, LHS: n.LHS, RHS: n.RHS}
+		}
+		if !negate {
+			return n
+		}
+	default:
+		if !negate {
+			return n
+		}
+	}
+	return &UnaryExpr{Op: NOT, Expr: unparen(expr)}
+}
+
+// distribute returns the clauses of an expression in negation normal form.
+func distribute(expr Expr, outer Token, maxClauses int) ([][]Expr, error) {
+	n, ok := expr.(*BinaryExpr)
+	if !ok || n.Op != AND && n.Op != OR {
+		return [][]Expr{{expr}}, nil
+	}
+	l, err := distribute(n.LHS, outer, maxClauses)
+	if err != nil {
+		return nil, err
+	}
+	r, err := distribute(n.RHS, outer, maxClauses)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.Op == outer {
+		if maxClauses > 0 && len(l)+len(r) > maxClauses {
+			return nil, ErrTooManyClauses
+		}
+		return append(l, r...), nil
+	}
+	if maxClauses > 0 && len(l)*len(r) > maxClauses {
+		return nil, ErrTooManyClauses
+	}
+	clauses := make([][]Expr, 0, len(l)*len(r))
+	for _, a := range l {
+		for _, b := range r {
+			clause := append([]Expr{}, a...)
+			for _, lit := range b {
+				if !containsExpr(clause, lit) {
+					clause = append(clause, lit)
+				}
+			}
+			clauses = append(clauses, clause)
+		}
+	}
+	return clauses, nil
+}
+
+// containsExpr reports whether list has an expression equal to expr.
+func containsExpr(list []Expr, expr Expr) bool {
+	for _, e := range list {
+		if Equal(e, expr) {
+			return true
+		}
+	}
+	return false
+}
+
+// dual returns OR for AND and AND for OR.
+func dual(op Token) Token {
+	if op == AND {
+		return OR
+	}
+	return AND
+}
+
+// join returns lhs op rhs, rhs alone if lhs is nil.
+func join(op Token, lhs, rhs Expr) Expr {
+	if lhs == nil {
+		return rhs
+	}
+	return &BinaryExpr{Op: op, LHS: lhs, RHS: rhs}
+}
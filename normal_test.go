@@ -0,0 +1,110 @@
+package conditions
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalForms(t *testing.T) {
+	data := []struct {
+		cond string
+		dnf  string
+		cnf  string
+	}{
+		{`[a]`, `[a]`, `[a]`},
+		{`[a] AND ([b] OR [c])`, `[a] AND [b] OR [a] AND [c]`, `[a] AND ([b] OR [c])`},
+		{`[a] OR [b] AND [c]`, `[a] OR [b] AND [c]`, `([a] OR [b]) AND ([a] OR [c])`},
+		{`([a] OR [b]) AND ([c] OR [d])`, `[a] AND [c] OR [a] AND [d] OR [b] AND [c] OR [b] AND [d]`, `([a] OR [b]) AND ([c] OR [d])`},
+		{`NOT ([a] AND NOT [b])`, `NOT [a] OR [b]`, `NOT [a] OR [b]`},
+		{`NOT ([x] < 1 OR [y] in [1, 2])`, `[x] >= 1 AND [y] NOT IN [1, 2]`, `[x] >= 1 AND [y] NOT IN [1, 2]`},
+		{`NOT ([x] == 1 AND [s] =~ /a/ AND [z] >= 2)`, `[x] != 1 OR [s] !~ /a/ OR [z] < 2`, `[x] != 1 OR [s] !~ /a/ OR [z] < 2`},
+		{`NOT ([x] != 1 OR [s] !~ "a" OR [z] <= 2 OR [y] > 0)`, `[x] == 1 AND [s] =~ "a" AND [z] > 2 AND [y] <= 0`, `[x] == 1 AND [s] =~ "a" AND [z] > 2 AND [y] <= 0`},
+		{`[a] NAND [b]`, `NOT [a] OR NOT [b]`, `NOT [a] OR NOT [b]`},
+		{`NOT ([a] NAND [b])`, `[a] AND [b]`, `[a] AND [b]`},
+		{`[a] XOR [b]`, `[a] AND NOT [b] OR NOT [a] AND [b]`, `([a] OR NOT [a]) AND ([a] OR [b]) AND (NOT [b] OR NOT [a]) AND (NOT [b] OR [b])`},
+		{`NOT ([a] XOR [b])`, `[a] AND [b] OR NOT [a] AND NOT [b]`, `([a] OR NOT [a]) AND ([a] OR NOT [b]) AND ([b] OR NOT [a]) AND ([b] OR NOT [b])`},
+		{`NOT NOT [a] AND NOT true`, `[a] AND false`, `[a] AND false`},
+		{`[a] AND ([a] OR [b])`, `[a] OR [a] AND [b]`, `[a] AND ([a] OR [b])`},
+		{`NOT ([x] + 1 > 2) AND NOT lower([s])`, `[x] + 1 <= 2 AND NOT lower([s])`, `[x] + 1 <= 2 AND NOT lower([s])`},
+		{`NOT ([x] IS NULL OR [y] IS NOT NULL) OR NOT EXISTS [z]`, `[x] IS NOT NULL AND [y] IS NULL OR NOT EXISTS [z]`, `([x] IS NOT NULL OR NOT EXISTS [z]) AND ([y] IS NULL OR NOT EXISTS [z])`},
+	}
+
+	funcs := NewFunctionRegistry()
+	assert.Nil(t, funcs.Register("lower", func(s string) bool { return s == strings.ToLower(s) }))
+	for _, td := range data {
+		p := NewParser(strings.NewReader(td.cond))
+		p.SetFunctions(funcs)
+		expr, err := p.Parse()
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+		dnf, err := ToDNF(expr)
+		if assert.Nil(t, err, td.cond) {
+			assert.Equal(t, td.dnf, Format(dnf), td.cond)
+		}
+		cnf, err := ToCNF(expr)
+		if assert.Nil(t, err, td.cond) {
+			assert.Equal(t, td.cnf, Format(cnf), td.cond)
+		}
+	}
+}
+
+func TestNormalFormsTruthTable(t *testing.T) {
+	conds := []string{
+		`([a] XOR [b]) NAND ([c] OR NOT [a])`,
+		`NOT ([a] AND ([b] XOR NOT [c])) OR [b] NAND [c]`,
+		`([a] OR [b]) AND ([b] OR [c]) AND NOT ([a] XOR [c])`,
+	}
+	for _, cond := range conds {
+		expr, err := NewParser(strings.NewReader(cond)).Parse()
+		if !assert.Nil(t, err, cond) {
+			continue
+		}
+		dnf, err := ToDNF(expr)
+		assert.Nil(t, err, cond)
+		cnf, err := ToCNF(expr)
+		assert.Nil(t, err, cond)
+
+		for i := 0; i < 8; i++ {
+			args := map[string]interface{}{"a": i&1 != 0, "b": i&2 != 0, "c": i&4 != 0}
+			want, err := Evaluate(expr, args)
+			assert.Nil(t, err, cond)
+			got, err := Evaluate(dnf, args)
+			assert.Nil(t, err, Format(dnf))
+			assert.Equal(t, want, got, "%s %v", Format(dnf), args)
+			got, err = Evaluate(cnf, args)
+			assert.Nil(t, err, Format(cnf))
+			assert.Equal(t, want, got, "%s %v", Format(cnf), args)
+		}
+	}
+}
+
+func TestNormalFormsLimit(t *testing.T) {
+	// Each factor doubles the number of clauses of the DNF.
+	cond := `([a0] OR [b0]) AND ([a1] OR [b1]) AND ([a2] OR [b2]) AND ([a3] OR [b3])`
+	expr, err := NewParser(strings.NewReader(cond)).Parse()
+	assert.Nil(t, err)
+
+	_, err = ToDNFWithLimit(expr, 16)
+	assert.Nil(t, err)
+	_, err = ToDNFWithLimit(expr, 15)
+	assert.Equal(t, ErrTooManyClauses, err)
+	_, err = ToCNFWithLimit(expr, 4)
+	assert.Nil(t, err)
+	_, err = ToCNFWithLimit(expr, 3)
+	assert.Equal(t, ErrTooManyClauses, err)
+
+	// A limit of 0 means no limit.
+	dnf, err := ToDNFWithLimit(expr, 0)
+	assert.Nil(t, err)
+	unlimited, err := ToDNFWithLimit(expr, 16)
+	assert.Nil(t, err)
+	assert.True(t, Equal(unlimited, dnf))
+	_, err = ToCNFWithLimit(expr, 0)
+	assert.Nil(t, err)
+
+	_, err = ToDNF(nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,213 @@
+package conditions
+
+import (
+	"fmt"
+	"math"
+)
+
+// Names of the rules applied by Optimize.
+const (
+	RuleParentheses    = "parentheses"
+	RuleConstantFold   = "constant folding"
+	RuleIdentity       = "identity"
+	RuleAnnihilator    = "annihilator"
+	RuleNegation       = "negation"
+	RuleDoubleNegation = "double negation"
+	RuleIdempotence    = "idempotence"
+	RuleAbsorption     = "absorption"
+)
+
+// Rewrite describes a single simplification made by Optimize.
+type Rewrite struct {
+	// Rule is the name of the applied rule, one of the Rule* constants
+	Rule   string
+	Before Expr
+	After  Expr
+}
+
+// String returns the string representation of the rewrite.
+func (r Rewrite) String() string {
+	before := Format(r.Before)
+	if _, ok := r.Before.(*ParenExpr); ok {
+		before = "(" + before + ")"
+	}
+	return fmt.Sprintf("%s: %s => %s", r.Rule, before, Format(r.After))
+}
+
+// Optimize returns a simplified expression giving the same results as
+// expr, see OptimizeWithReport.
+func Optimize(expr Expr) Expr {
+	expr, _ = OptimizeWithReport(expr)
+	return expr
+}
+
+// OptimizeWithReport simplifies the expression and returns the list of
+// rewrites made, innermost first. Sub-expressions of literals are folded
+// using the evaluation rules, function calls are never folded. Logical
+// operators with a constant operand are reduced by their identity and
+// annihilator elements, double negations, idempotent and absorbed
+// operands are removed and parentheses are dropped (Format adds the
+// required ones back).
+//
+// Operands made irrelevant by a constant are dropped, so an expression
+// which failed to evaluate, e.g. `[missing] > 5 OR true`, may succeed once
+// optimized. An expression with syntax errors is returned as is. The
+// expression given is not modified.
+func OptimizeWithReport(expr Expr) (Expr, []Rewrite) {
+	if hasBadExpr(expr) {
+		return expr, nil
+	}
+	o := &optimizer{}
+	return o.optimize(expr, true), o.rewrites
+}
+
+// optimizer collects the rewrites made while simplifying.
+type optimizer struct {
+	rewrites []Rewrite
+}
+
+func (o *optimizer) rewrite(rule string, before, after Expr) Expr {
+	o.rewrites = append(o.rewrites, Rewrite{Rule: rule, Before: before, After: after})
+	return after
+}
+
+// optimize simplifies expr bottom up. In a boolean context the result of
+// expr is an operand of a logical operator or the root, so the evaluation
+// fails either way when it is not a boolean.
+func (o *optimizer) optimize(expr Expr, boolean bool) Expr {
+	switch n := expr.(type) {
+	case *ParenExpr:
+		return o.optimize(o.rewrite(RuleParentheses, n, unparen(n)), boolean)
+	case *UnaryExpr:
+		if x := o.optimize(n.Expr, true); x != n.Expr {
+			n = &UnaryExpr{Op: n.Op, Expr: x}
+		}
+		return o.unary(n, boolean)
+	case *BinaryExpr:
+		logical := isLogical(n.Op)
+		l, r := o.optimize(n.LHS, logical), o.optimize(n.RHS, logical)
+		if l != n.LHS || r != n.RHS {
+			n = &BinaryExpr{Op: n.Op, LHS: l, RHS: r}
+		}
+		return o.binary(n, boolean)
+	case *CallExpr:
+		var args []Expr
+		for i, arg := range n.Arguments {
+			x := o.optimize(arg, false)
+			if x != arg && args == nil {
+				args = append([]Expr{}, n.Arguments...)
+			}
+			if args != nil {
+				args[i] = x
+			}
+		}
+		if args != nil {
+			return &CallExpr{Name: n.Name, Arguments: args, Func: n.Func}
+		}
+	}
+	return expr
+}
+
+func (o *optimizer) unary(n *UnaryExpr, boolean bool) Expr {
+	if isConstant(n.Expr) {
+		if v, err := applyUnaryOperator(n.Op, n.Expr); err == nil {
+			return o.rewrite(RuleConstantFold, n, v)
+		}
+	}
+	if x, ok := n.Expr.(*UnaryExpr); ok && n.Op == NOT && x.Op == NOT && isBooleanOperand(x.Expr, boolean) {
+		return o.rewrite(RuleDoubleNegation, n, x.Expr)
+	}
+	return n
+}
+
+func (o *optimizer) binary(n *BinaryExpr, boolean bool) Expr {
+	if isConstant(n.LHS) && isConstant(n.RHS) {
+		// Infinite and NaN results cannot be written as literals.
+		if v, err := applyOperator(n.Op, n.LHS, n.RHS); err == nil && isFinite(v) {
+			return o.rewrite(RuleConstantFold, n, v)
+		}
+		return n
+	}
+	if !isLogical(n.Op) {
+		return n
+	}
+
+	// Reduce by a constant operand, x is the other one.
+	for _, side := range [][2]Expr{{n.LHS, n.RHS}, {n.RHS, n.LHS}} {
+		c, ok := side[0].(*BooleanLiteral)
+		if !ok {
+			continue
+		}
+		x := side[1]
+		switch {
+		case (n.Op == AND || n.Op == OR) && c.Val == (n.Op == OR):
+			return o.rewrite(RuleAnnihilator, n, &BooleanLiteral{Val: c.Val})
+		case n.Op == NAND && !c.Val:
+			return o.rewrite(RuleAnnihilator, n, &BooleanLiteral{Val: true})
+		case (n.Op == AND && c.Val || n.Op == OR && !c.Val || n.Op == XOR && !c.Val) && isBooleanOperand(x, boolean):
+			return o.rewrite(RuleIdentity, n, x)
+		case n.Op == XOR && c.Val || n.Op == NAND && c.Val:
+			not := &UnaryExpr{Op: NOT, Expr: x}
+			o.rewrite(RuleNegation, n, not)
+			return o.unary(not, boolean)
+		}
+	}
+
+	if n.Op != AND && n.Op != OR || !isBooleanOperand(n.LHS, boolean) || !isBooleanOperand(n.RHS, boolean) {
+		return n
+	}
+	if isPure(n.LHS) && Equal(n.LHS, n.RHS) {
+		return o.rewrite(RuleIdempotence, n, n.LHS)
+	}
+	// x AND (x OR y) is x, as is x OR (x AND y).
+	for _, side := range [][2]Expr{{n.LHS, n.RHS}, {n.RHS, n.LHS}} {
+		x, y := side[0], side[1]
+		if b, ok := y.(*BinaryExpr); ok && b.Op == dual(n.Op) && isPure(y) && (Equal(x, b.LHS) || Equal(x, b.RHS)) {
+			return o.rewrite(RuleAbsorption, n, x)
+		}
+	}
+	return n
+}
+
+// isLogical reports whether op is a logical operator of booleans.
+func isLogical(op Token) bool {
+	return op == AND || op == OR || op == XOR || op == NAND
+}
+
+// isBooleanOperand reports whether expr may replace a boolean expression,
+// either because it results in a boolean or its result is used as one.
+func isBooleanOperand(expr Expr, boolean bool) bool {
+	return boolean || staticType(expr) == Boolean
+}
+
+// isConstant reports whether expr is a literal.
+func isConstant(expr Expr) bool {
+	switch expr.(type) {
+	case *NumberLiteral, *StringLiteral, *RegexLiteral, *BooleanLiteral,
+		*SliceStringLiteral, *SliceNumberLiteral, *TimeLiteral, *DurationLiteral:
+		return true
+	}
+	return false
+}
+
+// isFinite reports whether expr is not an infinite or NaN number.
+func isFinite(expr Expr) bool {
+	n, ok := expr.(*NumberLiteral)
+	return !ok || !math.IsInf(n.Val, 0) && !math.IsNaN(n.Val)
+}
+
+// isPure reports whether expr calls no function, so evaluating it twice
+// gives the same result.
+func isPure(expr Expr) bool {
+	switch n := expr.(type) {
+	case *CallExpr:
+		return false
+	case *ParenExpr:
+		return isPure(n.Expr)
+	case *UnaryExpr:
+		return isPure(n.Expr)
+	case *BinaryExpr:
+		return isPure(n.LHS) && isPure(n.RHS)
+	}
+	return true
+}
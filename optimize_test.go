@@ -0,0 +1,134 @@
+package conditions
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptimize(t *testing.T) {
+	data := []struct {
+		cond  string
+		want  string
+		rules []string
+	}{
+		{`[a] > 1`, `[a] > 1`, nil},
+		{`(([a] > 1))`, `[a] > 1`, []string{RuleParentheses}},
+		{`[a] > 2 * 3 + 1`, `[a] > 7`, []string{RuleConstantFold, RuleConstantFold}},
+		{`[d] > 1h + 30m AND [t] < TIME "2017-09-13" - 1h`, `[d] > 90m AND [t] < TIME "2017-09-12T23:00:00Z"`, []string{RuleConstantFold, RuleConstantFold}},
+		{`"abc" =~ /^a/ AND [a]`, `[a]`, []string{RuleConstantFold, RuleIdentity}},
+		{`true AND ([a] > 1)`, `[a] > 1`, []string{RuleParentheses, RuleIdentity}},
+		{`[a] > 5 OR true`, `true`, []string{RuleAnnihilator}},
+		{`false AND [a]`, `false`, []string{RuleAnnihilator}},
+		{`[a] NAND false`, `true`, []string{RuleAnnihilator}},
+		{`[a] XOR false OR false`, `[a]`, []string{RuleIdentity, RuleIdentity}},
+		{`[a] XOR true`, `NOT [a]`, []string{RuleNegation}},
+		{`NOT [a] NAND true`, `[a]`, []string{RuleNegation, RuleDoubleNegation}},
+		{`NOT NOT ([a] > 1)`, `[a] > 1`, []string{RuleParentheses, RuleDoubleNegation}},
+		{`NOT !true`, `true`, []string{RuleConstantFold, RuleConstantFold}},
+		{`[a] AND [a]`, `[a]`, []string{RuleIdempotence}},
+		{`[a] AND ([b] OR [a])`, `[a]`, []string{RuleParentheses, RuleAbsorption}},
+		{`[a] > 1 AND [b] OR [a] > 1`, `[a] > 1`, []string{RuleAbsorption}},
+		{`1 + 2 == [a] AND true AND (false OR [b])`, `3 == [a] AND [b]`, []string{RuleConstantFold, RuleIdentity, RuleParentheses, RuleIdentity}},
+
+		// The result of the logical operators is used as a value, a non
+		// boolean operand must still fail the evaluation.
+		{`([a] AND true) == [b]`, `([a] AND true) == [b]`, []string{RuleParentheses}},
+		{`([a] > 1 AND true) == [b]`, `[a] > 1 == [b]`, []string{RuleParentheses, RuleIdentity}},
+		{`(NOT NOT [a]) == [b]`, `(NOT NOT [a]) == [b]`, []string{RuleParentheses}},
+
+		// Failing operations are left to the evaluation.
+		{`1 / 0 > [a]`, `1 / 0 > [a]`, nil},
+		{`"a" AND [a]`, `"a" AND [a]`, nil},
+
+		// Infinite results cannot be written as literals.
+		{`[a] > 1e308 * 10`, `[a] > 1e+308 * 10`, nil},
+		{`[a] > 2 * 3 - 1e308 * 10`, `[a] > 6 - 1e+308 * 10`, []string{RuleConstantFold}},
+	}
+
+	for _, td := range data {
+		expr, err := NewParser(strings.NewReader(td.cond)).Parse()
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+		source := Format(expr)
+		got, rewrites := OptimizeWithReport(expr)
+		assert.Equal(t, td.want, Format(got), td.cond)
+		assert.Equal(t, source, Format(expr), "%s was modified", td.cond)
+
+		// The result can be written out and read back.
+		again, err := NewParser(strings.NewReader(Format(got))).Parse()
+		if assert.Nil(t, err, td.cond) {
+			assert.True(t, Equal(got, again), td.cond)
+		}
+		data, err := MarshalExpr(got)
+		if assert.Nil(t, err, td.cond) {
+			decoded, err := UnmarshalExpr(data, nil)
+			assert.Nil(t, err, td.cond)
+			assert.True(t, Equal(got, decoded), td.cond)
+		}
+
+		var rules []string
+		for _, rw := range rewrites {
+			rules = append(rules, rw.Rule)
+		}
+		assert.Equal(t, td.rules, rules, td.cond)
+	}
+}
+
+func TestOptimizeCalls(t *testing.T) {
+	funcs := NewFunctionRegistry()
+	assert.Nil(t, funcs.Register("random", rand.Float64))
+	assert.Nil(t, funcs.Register("lower", strings.ToLower))
+
+	data := []struct {
+		cond string
+		want string
+	}{
+		{`random() > 0.5 AND random() > 0.5`, `random() > 0.5 AND random() > 0.5`},
+		{`lower("A") == "a"`, `lower("A") == "a"`},
+		{`lower((("A"))) == [a] AND true`, `lower("A") == [a]`},
+	}
+	for _, td := range data {
+		p := NewParser(strings.NewReader(td.cond))
+		p.SetFunctions(funcs)
+		expr, err := p.Parse()
+		if assert.Nil(t, err, td.cond) {
+			assert.Equal(t, td.want, Format(Optimize(expr)), td.cond)
+		}
+	}
+}
+
+func TestOptimizeMatchesEvaluate(t *testing.T) {
+	for _, td := range validTestData {
+		expr, err := NewParser(strings.NewReader(td.cond)).Parse()
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+		want, err := Evaluate(expr, td.args)
+		if err != nil {
+			// Dropped operands may make a failing expression succeed.
+			continue
+		}
+		got, err := Evaluate(Optimize(expr), td.args)
+		assert.Nil(t, err, td.cond)
+		assert.Equal(t, want, got, td.cond)
+	}
+}
+
+func TestRewriteString(t *testing.T) {
+	expr, err := NewParser(strings.NewReader(`(true OR [a]) AND [b]`)).Parse()
+	assert.Nil(t, err)
+	_, rewrites := OptimizeWithReport(expr)
+	var lines []string
+	for _, rw := range rewrites {
+		lines = append(lines, rw.String())
+	}
+	assert.Equal(t, []string{
+		"parentheses: (true OR [a]) => true OR [a]",
+		"annihilator: true OR [a] => true",
+		"identity: true AND [b] => [b]",
+	}, lines)
+}
@@ -1,205 +1,410 @@
 package conditions
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strconv"
 	"strings"
-	"text/scanner"
+	"unicode/utf8"
 )
 
-// Parser encapsulates the scanner and responsible for returning AST
+// Parser encapsulates the lexer and responsible for returning AST
 // composed from statements read from a given reader.
 type Parser struct {
-	// Text scanner
-	s scanner.Scanner
+	// Lexer of the source
+	lex *Lexer
 	// Buffer to keep the read forward token
 	buf struct {
-		tok rune   // last read token
-		tt  string // token text
+		tok Token  // last read token
+		lit string // token literal
+		pos Pos    // position of the token
 		n   int    // buffer size (max=1)
 	}
+	// Source being parsed, used to render error snippets
+	src string
+	// First error reported while reading or lexing the source
+	err error
+	// Functions available to the parsed conditions
+	funcs *FunctionRegistry
+	// Limits on the regular expression literals
+	regexLimits RegexLimits
+	// Recovery mode, see ParseWithRecovery
+	recovering bool
+	// Errors collected in recovery mode
+	errs ParseErrors
+	// Enclosing groups, LPAREN for parentheses and FUNC for call arguments
+	nest []Token
+	// Resource limits
+	opts ParserOptions
+	// Current nesting depth and number of nodes, checked against opts
+	depth int
+	nodes int
+}
+
+// DefaultMaxDepth is the maximum nesting depth of the parsed expressions
+// when ParserOptions.MaxDepth is 0, it protects the stack of the recursive
+// descent parser.
+const DefaultMaxDepth = 10000
+
+// Errors of the parser resource limits, returned as the Err field of a
+// *ParseError.
+var (
+	ErrSourceTooLong  = errors.New("Source exceeds the maximum length")
+	ErrNestingTooDeep = errors.New("Nesting exceeds the maximum depth")
+	ErrArrayTooLarge  = errors.New("Array exceeds the maximum number of elements")
+	ErrTooManyNodes   = errors.New("Expression exceeds the maximum number of nodes")
+)
+
+// ParserOptions limits the resources used to parse untrusted input. A
+// limit of 0 means no limit.
+type ParserOptions struct {
+	// MaxLength is the maximum length of the source in bytes.
+	MaxLength int
+	// MaxDepth is the maximum nesting of parentheses, NOT operators and
+	// function calls, DefaultMaxDepth if 0.
+	MaxDepth int
+	// MaxArrayElements is the maximum number of elements of an array
+	// literal.
+	MaxArrayElements int
+	// MaxNodes is the maximum number of nodes of the expression.
+	MaxNodes int
 }
 
 // NewParser returns a new instance of Parser.
 func NewParser(r io.Reader) *Parser {
-	p := &Parser{s: scanner.Scanner{}}
-	p.s.Mode = scanner.ScanIdents | scanner.ScanFloats | scanner.ScanStrings
-	p.s.Init(r)
+	return NewParserWithOptions(r, ParserOptions{})
+}
+
+// NewParserWithOptions returns a new instance of Parser enforcing the
+// given resource limits.
+func NewParserWithOptions(r io.Reader, opts ParserOptions) *Parser {
+	p := &Parser{opts: opts}
+	if p.opts.MaxDepth == 0 {
+		p.opts.MaxDepth = DefaultMaxDepth
+	}
+	if opts.MaxLength > 0 {
+		// Do not read more of a source which is too long anyway.
+		r = io.LimitReader(r, int64(opts.MaxLength)+1)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		p.err = err
+	}
+	p.src = string(b)
+	if opts.MaxLength > 0 && len(b) > opts.MaxLength {
+		p.src = string(b[:opts.MaxLength])
+		p.err = p.limitError(endPos(p.src), ErrSourceTooLong, opts.MaxLength)
+	}
+	p.lex = NewLexer(p.src)
+	p.lex.Error = func(pos Pos, msg string) {
+		err := p.errorf(pos, "%s", msg)
+		if p.recovering {
+			p.addError(err)
+		} else if p.err == nil {
+			p.err = err
+		}
+	}
 	return p
 }
 
-// Parse starts scanning & parsing process (main entry point).
-// It returns an expression (AST) which you can use for the final evaluation
-// of the conditions/statements
-func (p *Parser) Parse() (Expr, error) {
-	return p.parseExpr()
+// Pos specifies the position of a token in the source.
+type Pos struct {
+	Offset int // byte offset, starting at 0
+	Line   int // line number, starting at 1
+	Column int // column number, starting at 1 (character count per line)
 }
 
-// scan returns the next token from the underlying scanner.
-// If a token has been unscanned then read that instead.
-func (p *Parser) scan() (rune, string) {
-	// If we have a token on the buffer, then return it.
-	if p.buf.n != 0 {
-		p.buf.n = 0
+// String returns a string representation of the position.
+func (p Pos) String() string { return fmt.Sprintf("line %d, column %d", p.Line, p.Column) }
+
+// ParseError represents an error that occurred during parsing.
+type ParseError struct {
+	Message  string
+	Found    string
+	Expected []string
+	Pos      Pos
+	// Err is the exceeded limit of ParserOptions, e.g. ErrNestingTooDeep
+	Err error
+
+	// line of the source the error occurred on
+	line string
+}
+
+// Error returns the string representation of the error followed by the
+// source line with a caret pointing at the error position.
+func (e *ParseError) Error() string {
+	var msg string
+	if e.Message != "" {
+		msg = fmt.Sprintf("%s at %s", e.Message, e.Pos)
 	} else {
-		// Otherwise read and put into buffer in case we 'unscan' it later
-		p.buf.tok, p.buf.tt = p.s.Scan(), p.s.TokenText()
+		msg = fmt.Sprintf("found %s, expected %s at %s", e.Found, strings.Join(e.Expected, ", "), e.Pos)
+	}
+	if snippet := e.Snippet(); snippet != "" {
+		msg += "\n" + snippet
 	}
-	return p.buf.tok, p.buf.tt
+	return msg
 }
 
-// scanWithMapping uses scan with buffer (supports 'unscan') and maps
-// scanner's tokens to our custom tokens.
-func (p *Parser) scanWithMapping() (Token, string) {
-	var (
-		t   rune
-		tok Token
-		tt  string
-	)
+// Unwrap returns the exceeded limit error, if any.
+func (e *ParseError) Unwrap() error { return e.Err }
 
-	t, tt = p.scan()
-
-	// Map Go's token to our Token
-	switch t {
-	case scanner.EOF:
-		tok = EOF
-	case '(':
-		tok = LPAREN
-	case ')':
-		tok = RPAREN
-	case '-':
-		t, tt = p.scan()
-
-		if t == scanner.Float || t == scanner.Int {
-			tok = NUMBER
-			tt = "-" + tt
+// Snippet returns the source line the error occurred on and a line with
+// a caret under the error position.
+func (e *ParseError) Snippet() string {
+	if e.line == "" || e.Pos.Column < 1 {
+		return ""
+	}
+	// Keep tabs so the caret lines up with the source.
+	var caret []rune
+	for i, r := range []rune(e.line) {
+		if i >= e.Pos.Column-1 {
+			break
+		}
+		if r == '\t' {
+			caret = append(caret, '\t')
 		} else {
-			tok = ILLEGAL
+			caret = append(caret, ' ')
 		}
-	case scanner.Float, scanner.Int:
-		tok = NUMBER
-	case '$':
-		t, tt = p.scan()
+	}
+	return e.line + "\n" + string(caret) + "^"
+}
 
-		if t == scanner.Float || t == scanner.Int {
-			tok = IDENT
-			tt = "$" + tt
+// ParseErrors is the list of syntax errors found in recovery mode.
+type ParseErrors []*ParseError
 
-		} else {
-			tok = ILLEGAL
-		}
-	case '[':
+// Error returns the string representation of the errors.
+func (e ParseErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
 
-		// TODO : capter les tableau de string comme ["hello", "world", "foo"] => StringLiteral
-		var err error
-		t, tt, err = p.scanArg()
-		if err != nil {
-			p.unscan()
-			t, tt, err = p.scanArray(tt)
-			if err == nil {
-				tok = ARRAY
-			} else {
-				tok = ILLEGAL
-			}
-		} else {
-			tok = IDENT
-		}
-	case '!':
-		t, tt = p.scan()
+// newParseError returns a new instance of ParseError.
+func (p *Parser) newParseError(found string, expected []string, pos Pos) *ParseError {
+	return &ParseError{Found: found, Expected: expected, Pos: pos, line: p.sourceLine(pos)}
+}
 
-		if t == '=' {
-			tok = NEQ
-			tt = "!="
-		} else if t == '~' {
-			tok = NEREG
-			tt = "!~"
-		} else {
-			tok = ILLEGAL
-		}
-	case '>':
-		t, tt = p.scan()
+// errorf returns a ParseError with a custom message.
+func (p *Parser) errorf(pos Pos, format string, args ...interface{}) *ParseError {
+	return &ParseError{Message: fmt.Sprintf(format, args...), Pos: pos, line: p.sourceLine(pos)}
+}
 
-		if t == '=' {
-			tok = GTE
-			tt = ">="
-		} else {
-			tok = GT
-			tt = ">"
-			p.unscan()
-		}
-	case '<':
-		t, tt = p.scan()
+// limitError returns an error for a resource limit exceeded at pos.
+func (p *Parser) limitError(pos Pos, err error, limit int) *ParseError {
+	e := p.errorf(pos, "%s (%d)", err, limit)
+	e.Err = err
+	return e
+}
 
-		if t == '=' {
-			tok = LTE
-			tt = "<="
-		} else {
-			tok = LT
-			tt = "<"
-			p.unscan()
-		}
-	case '=':
-		t, tt = p.scan()
+// enter checks the depth of a nested group, leave must be called once the
+// group is parsed.
+func (p *Parser) enter() error {
+	if p.depth >= p.opts.MaxDepth {
+		return p.limitError(p.buf.pos, ErrNestingTooDeep, p.opts.MaxDepth)
+	}
+	p.depth++
+	return nil
+}
 
-		if t == '=' {
-			tok = EQ
-			tt = "=="
-		} else if t == '~' {
-			tok = EREG
-			tt = "=~"
-		} else {
-			tok = ILLEGAL
-		}
+func (p *Parser) leave() {
+	p.depth--
+}
 
-	case '/':
-		var ttTmp string
-		for {
-			t, ttTmp = p.scan()
-			tt = tt + ttTmp
-			if t == '/' {
-				tok = STRING
-				break
-			}
+// addNode counts a node of the expression.
+func (p *Parser) addNode() error {
+	p.nodes++
+	if p.opts.MaxNodes > 0 && p.nodes > p.opts.MaxNodes {
+		return p.limitError(p.buf.pos, ErrTooManyNodes, p.opts.MaxNodes)
+	}
+	return nil
+}
+
+// endPos returns the position of the end of src.
+func endPos(src string) Pos {
+	line := strings.Count(src, "\n") + 1
+	col := utf8.RuneCountInString(src[strings.LastIndex(src, "\n")+1:]) + 1
+	return Pos{Offset: len(src), Line: line, Column: col}
+}
+
+// unexpected returns an error for the last scanned token, or the lexer
+// error which caused it.
+func (p *Parser) unexpected(expected ...string) error {
+	if p.err != nil {
+		return p.err
+	}
+	found := tokstr(p.buf.tok, p.buf.lit)
+	if p.buf.tok == STRING {
+		found = Quote(p.buf.lit)
+	}
+	return p.newParseError(found, expected, p.buf.pos)
+}
+
+// sourceLine returns the line of the source at the given position
+func (p *Parser) sourceLine(pos Pos) string {
+	if pos.Line < 1 {
+		return ""
+	}
+	lines := strings.Split(p.src, "\n")
+	if pos.Line > len(lines) {
+		return ""
+	}
+	return lines[pos.Line-1]
+}
+
+// operandTokens are the tokens an operand can start with.
+var operandTokens = []string{
+	LPAREN.String(), NOT.String(), EXISTS.String(), SUB.String(), IDENT.String(), NUMBER.String(),
+	STRING.String(), ARRAY.String(), TRUE.String(), FALSE.String(),
+	DURATION.String(), TIME.String(), FUNC.String(), "/",
+}
+
+// SetFunctions makes the functions of the registry callable from the
+// parsed conditions. Calls are checked against their signatures while parsing.
+func (p *Parser) SetFunctions(funcs *FunctionRegistry) {
+	p.funcs = funcs
+}
+
+// SetRegexLimits bounds the size of the regular expression literals and of
+// the patterns matched as strings, so conditions written by untrusted users
+// cannot submit huge patterns.
+func (p *Parser) SetRegexLimits(limits RegexLimits) {
+	p.regexLimits = limits
+}
+
+// Parse starts scanning & parsing process (main entry point).
+// It returns an expression (AST) which you can use for the final evaluation
+// of the conditions/statements. Syntax errors are returned as *ParseError.
+func (p *Parser) Parse() (Expr, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	// The whole source has to be consumed.
+	if tok, _ := p.scan(); tok != EOF {
+		return nil, p.unexpected("operator", EOF.String())
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return expr, nil
+}
+
+// ParseWithRecovery parses the source like Parse but does not stop at the
+// first syntax error. It resynchronises at the next operator or parenthesis
+// and carries on, so every error is reported at once, sorted by position.
+// The returned expression is a partial AST in which the unparsable parts
+// are replaced by *BadExpr nodes. Errors are nil if the source is valid.
+func (p *Parser) ParseWithRecovery() (Expr, ParseErrors) {
+	if perr, ok := p.err.(*ParseError); ok {
+		return nil, ParseErrors{perr}
+	}
+	if p.err != nil {
+		return nil, ParseErrors{p.errorf(Pos{}, "%s", p.err)}
+	}
+	p.recovering = true
+	defer func() { p.recovering = false }()
+
+	// Outside of any group parseExpr only stops at the end of the source.
+	expr, err := p.parseExpr()
+	if err != nil {
+		p.addError(err)
+	}
+	sort.SliceStable(p.errs, func(i, j int) bool {
+		return p.errs[i].Pos.Offset < p.errs[j].Pos.Offset
+	})
+	return expr, p.errs
+}
+
+// addError records an error in recovery mode. An error reported twice at
+// the same position, by the lexer and then by the parser, is kept once.
+func (p *Parser) addError(err error) *ParseError {
+	perr, ok := err.(*ParseError)
+	if !ok {
+		perr = p.errorf(p.buf.pos, "%s", err)
+	}
+	for _, e := range p.errs {
+		if e.Pos == perr.Pos {
+			return e
 		}
+	}
+	p.errs = append(p.errs, perr)
+	return perr
+}
 
-	case scanner.String:
-		tok = STRING
-	case scanner.Ident:
-		ttU := strings.ToUpper(tt)
-
-		if ttU == "AND" {
-			tok = AND
-		} else if ttU == "OR" {
-			tok = OR
-		} else if ttU == "XOR" {
-			tok = XOR
-		} else if ttU == "NAND" {
-			tok = NAND
-		} else if ttU == "IN" {
-			tok = IN
-		} else if ttU == "NOT" {
-			_, tmp := p.scan()
-			if strings.ToUpper(tmp) == "IN" {
-				tok = NOTIN
-				tt = "NOT IN"
-			} else {
-				p.unscan()
-				tok = ILLEGAL
-			}
-		} else if ttU == "TRUE" {
-			tok = TRUE
-		} else if ttU == "FALSE" {
-			tok = FALSE
-		} else if strings.HasPrefix(ttU, "C") || strings.HasPrefix(ttU, "P") {
-			tok = IDENT
-		} else {
-			tok = ILLEGAL
+// report returns err, unless in recovery mode where the error is recorded
+// and parsing carries on.
+func (p *Parser) report(err error) error {
+	if !p.recovering {
+		return err
+	}
+	p.addError(err)
+	return nil
+}
+
+// bad returns err, unless in recovery mode where the error is recorded and
+// an error node is returned in place of the expression.
+func (p *Parser) bad(err error) (Expr, error) {
+	if !p.recovering {
+		return nil, err
+	}
+	return &BadExpr{Err: p.addError(err)}, nil
+}
+
+// badOperand is bad for an unexpected token in place of an operand. In
+// recovery mode the token and those following it are skipped up to the
+// next synchronisation point.
+func (p *Parser) badOperand(err error) (Expr, error) {
+	if p.recovering {
+		p.unscan()
+		p.synchronize()
+	}
+	return p.bad(err)
+}
+
+// synchronize skips tokens up to the next synchronisation point and
+// leaves it to be read next.
+func (p *Parser) synchronize() {
+	for {
+		tok, _ := p.scan()
+		if p.isSyncToken(tok) {
+			p.unscan()
+			return
 		}
 	}
+}
+
+// isSyncToken reports whether the parser can resume at tok: an operator,
+// the end of the source, a parenthesis closing the current group or an
+// argument separator in a call.
+func (p *Parser) isSyncToken(tok Token) bool {
+	switch {
+	case tok == EOF, tok.isOperator():
+		return true
+	case tok == RPAREN:
+		return len(p.nest) > 0
+	case tok == COMMA:
+		return len(p.nest) > 0 && p.nest[len(p.nest)-1] == FUNC
+	}
+	return false
+}
 
-	return tok, tt
+// scan returns the next token from the lexer. If a token has been
+// unscanned then read that instead.
+func (p *Parser) scan() (Token, string) {
+	if p.buf.n != 0 {
+		p.buf.n = 0
+		return p.buf.tok, p.buf.lit
+	}
+	p.buf.tok, p.buf.lit, p.buf.pos = p.lex.Scan()
+	return p.buf.tok, p.buf.lit
 }
 
 // unscan pushes the previously read token back onto the buffer.
@@ -209,6 +414,12 @@ func (p *Parser) unscan() {
 
 // parseExpr is an entry point to parsing
 func (p *Parser) parseExpr() (Expr, error) {
+	return p.parseBinaryExpr(0)
+}
+
+// parseBinaryExpr parses the operations of the operators of precedence
+// prec and higher.
+func (p *Parser) parseBinaryExpr(prec int) (Expr, error) {
 	// Parse a non-binary expression type to start.
 	// This variable will always be the root of the expression tree.
 	expr, err := p.parseUnaryExpr()
@@ -217,155 +428,314 @@ func (p *Parser) parseExpr() (Expr, error) {
 	}
 
 	// Loop over operations and unary exprs and build a tree based on precendence.
+	// The root is a placeholder whose RHS holds the actual tree.
+	root := &BinaryExpr{RHS: expr}
 	for {
 		// If the next token is NOT an operator then return the expression.
-		op, tx := p.scanWithMapping()
-		if op == ILLEGAL {
-			return nil, fmt.Errorf("ILLEGAL %s", tx)
+		op, _ := p.scan()
+		if op == ILLEGAL && !p.recovering {
+			return nil, p.unexpected("operator")
 		}
-		if !op.isOperator() {
+		if prec > 0 && (!op.isOperator() || op.Precedence() < prec) {
+			// The weaker operator belongs to the enclosing expression.
 			p.unscan()
-			return expr, nil
-
+			return root.RHS, nil
+		}
+		if !op.isOperator() {
+			if !p.recovering || p.isSyncToken(op) {
+				p.unscan()
+				return root.RHS, nil
+			}
+			// Skip the garbage and carry on from the next operator.
+			p.addError(p.unexpected("operator"))
+			p.synchronize()
+			continue
 		}
 
 		// Otherwise parse the next unary expression.
+		if err := p.addNode(); err != nil {
+			return nil, err
+		}
+		p.scan()
+		pos := p.buf.pos
+		p.unscan()
 		rhs, err := p.parseUnaryExpr()
 		if err != nil {
 			return nil, err
 		}
+		if err := p.regexLimits.checkPattern(op, rhs); err != nil {
+			if rhs, err = p.bad(p.errorf(pos, "%s", err)); err != nil {
+				return nil, err
+			}
+		}
 
-		// Assign the new root based on the precendence of the LHS and RHS operators.
-		if lhs, ok := expr.(*BinaryExpr); ok && lhs.Op.Precedence() <= op.Precedence() {
-			expr = &BinaryExpr{
-				LHS: lhs.LHS,
-				RHS: &BinaryExpr{LHS: lhs.RHS, RHS: rhs, Op: op},
-				Op:  lhs.Op,
+		// Descend the right side of the tree while its operators bind
+		// weaker than the new one, then attach the new operation there.
+		for node := root; ; {
+			r, ok := node.RHS.(*BinaryExpr)
+			if !ok || r.Op.Precedence() >= op.Precedence() {
+				node.RHS = &BinaryExpr{LHS: node.RHS, RHS: rhs, Op: op}
+				break
 			}
-		} else {
-			expr = &BinaryExpr{LHS: expr, RHS: rhs, Op: op}
+			node = r
 		}
 	}
-
 }
 
 // parseUnaryExpr parses an non-binary expression.
 func (p *Parser) parseUnaryExpr() (Expr, error) {
 	// If the first token is a LPAREN then parse it as its own grouped expression.
-	tok, lit := p.scanWithMapping()
+	tok, lit := p.scan()
+	if err := p.addNode(); err != nil {
+		return nil, err
+	}
 	if tok == LPAREN {
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		p.nest = append(p.nest, LPAREN)
 		expr, err := p.parseExpr()
+		p.nest = p.nest[:len(p.nest)-1]
+		p.leave()
 		if err != nil {
 			return nil, err
 		}
 
 		// Expect an RPAREN at the end.
-		if tok, _ := p.scanWithMapping(); tok != RPAREN {
-			return nil, fmt.Errorf("Missing )")
+		if tok, _ := p.scan(); tok != RPAREN {
+			if err := p.report(p.unexpected("operator", RPAREN.String())); err != nil {
+				return nil, err
+			}
+			p.unscan()
 		}
 
 		return &ParenExpr{Expr: expr}, nil
 	}
 
 	// Read next token.
+	pos := p.buf.pos
 	switch tok {
+	case NOT:
+		// As in SQL, NOT applies to the comparison following it:
+		// NOT [a] == 1 is NOT ([a] == 1).
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		expr, err := p.parseBinaryExpr(EQ.Precedence())
+		p.leave()
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryExpr{Op: NOT, Expr: expr}, nil
+	case EXISTS:
+		// EXISTS only applies to a variable reference.
+		if tok, lit = p.scan(); tok != IDENT {
+			return p.badOperand(p.unexpected(IDENT.String()))
+		}
+		if err := p.addNode(); err != nil {
+			return nil, err
+		}
+		return &UnaryExpr{Op: EXISTS, Expr: &VarRef{Val: lit, Path: strings.Split(lit, ".")}}, nil
+	case FUNC:
+		return p.parseCallExpr(lit, pos)
+	case SUB:
+		// Only numbers and durations can be negated.
+		tok, lit = p.scan()
+		switch tok {
+		case NUMBER:
+			v, err := strconv.ParseFloat(lit, 64)
+			if err != nil {
+				return p.bad(p.errorf(pos, "Unable to parse number %s", lit))
+			}
+			return &NumberLiteral{Val: -v}, nil
+		case DURATION:
+			d, err := ParseDuration(lit)
+			if err != nil {
+				return p.bad(p.errorf(pos, "%s", err))
+			}
+			return &DurationLiteral{Val: -d}, nil
+		}
+		return p.badOperand(p.unexpected(NUMBER.String(), DURATION.String()))
+	case DURATION:
+		d, err := ParseDuration(lit)
+		if err != nil {
+			return p.bad(p.errorf(pos, "%s", err))
+		}
+		return &DurationLiteral{Val: d}, nil
+	case TIME:
+		// TIME is followed by the timestamp as a string.
+		tok, lit = p.scan()
+		if tok != STRING {
+			return p.badOperand(p.unexpected(STRING.String()))
+		}
+		t, err := ParseTime(lit)
+		if err != nil {
+			return p.bad(p.errorf(pos, "%s", err))
+		}
+		return &TimeLiteral{Val: t}, nil
+	case DIV:
+		// A slash in place of an operand starts a regular expression.
+		pattern, flags, err := p.lex.ScanRegex()
+		if err != nil {
+			return p.bad(p.errorf(pos, "%s", err))
+		}
+		re, err := NewRegexLiteral(pattern, flags, p.regexLimits)
+		if err != nil {
+			return p.bad(p.errorf(pos, "%s", err))
+		}
+		return re, nil
 	case IDENT:
-		return &VarRef{Val: lit}, nil
+		ref := &VarRef{Val: lit, Path: strings.Split(lit, ".")}
+		// A variable reference may be followed by IS [NOT] NULL.
+		if tok, _ := p.scan(); tok == ISNULL || tok == ISNOTNULL {
+			if err := p.addNode(); err != nil {
+				return nil, err
+			}
+			return &UnaryExpr{Op: tok, Expr: ref}, nil
+		}
+		p.unscan()
+		return ref, nil
 	case STRING:
-		return &StringLiteral{Val: lit[1 : len(lit)-1]}, nil
+		return &StringLiteral{Val: lit}, nil
 	case NUMBER:
 		v, err := strconv.ParseFloat(lit, 64)
 		if err != nil {
-			return nil, fmt.Errorf("Unable to parse number")
+			return p.bad(p.errorf(pos, "Unable to parse number %s", lit))
 		}
 		return &NumberLiteral{Val: v}, nil
 	case TRUE, FALSE:
 		return &BooleanLiteral{Val: (tok == TRUE)}, nil
 	case ARRAY:
-		mapVal := []interface{}{}
-		err := json.Unmarshal([]byte(`[`+lit+`]`), &mapVal)
-		if len(mapVal) == 0 {
-			return nil, fmt.Errorf("Empty Slice not castable")
-		}
-		switch t := mapVal[0].(type) {
-		case string:
-			values := []string{}
-			for _, v := range mapVal {
-				values = append(values, v.(string))
-			}
-			return &SliceStringLiteral{Val: values}, err
-		case float64:
-			values := []float64{}
-			for _, v := range mapVal {
-				values = append(values, v.(float64))
-			}
-			return &SliceNumberLiteral{Val: values}, err
-		default:
-			return nil, fmt.Errorf("Slice of unknow type %s %T", t, t)
-		}
+		return p.parseArray(lit, pos)
 
 	default:
-		return nil, fmt.Errorf("Parsing error: tok=%v, lit=%v", tok, lit)
+		return p.badOperand(p.unexpected(operandTokens...))
 	}
 }
 
-func (p *Parser) scanArray(tt string) (rune, string, error) {
-	var t rune
-
-	var ttTmp string
-	var sep string
-
+// parseArray parses the elements of an array literal, which are either
+// all strings or all numbers.
+func (p *Parser) parseArray(src string, pos Pos) (Expr, error) {
+	var (
+		strs []string
+		nums []float64
+	)
+	lex := NewLexer(src)
 	for {
-		t, ttTmp = p.scan()
-		if t == ']' {
-			return t, tt, nil
+		tok, lit, _ := lex.Scan()
+		if tok == EOF && strs == nil && nums == nil {
+			return p.bad(p.errorf(pos, "Empty Slice not castable"))
+		}
+		sign, signed := 1.0, tok == SUB || tok == ADD
+		if tok == SUB {
+			sign = -1
+		}
+		if signed {
+			tok, lit, _ = lex.Scan()
 		}
 
-		tt = tt + sep + ttTmp
-		// pp.Print(tt)
-		// fmt.Printf("\n")
-	}
+		if max := p.opts.MaxArrayElements; max > 0 && len(strs)+len(nums) >= max {
+			return nil, p.limitError(pos, ErrArrayTooLarge, max)
+		}
 
-	return t, tt, nil
+		switch {
+		case tok == STRING && !signed:
+			if nums != nil {
+				return p.bad(p.errorf(pos, "Mixed types in slice of number"))
+			}
+			strs = append(strs, lit)
+		case tok == NUMBER:
+			if strs != nil {
+				return p.bad(p.errorf(pos, "Mixed types in slice of string"))
+			}
+			v, err := strconv.ParseFloat(lit, 64)
+			if err != nil {
+				return p.bad(p.errorf(pos, "Unable to parse number %s", lit))
+			}
+			nums = append(nums, sign*v)
+		default:
+			return p.bad(p.errorf(pos, "Invalid array: unexpected %s", tokstr(tok, lit)))
+		}
 
+		switch tok, lit, _ := lex.Scan(); tok {
+		case COMMA:
+			continue
+		case EOF:
+			if strs != nil {
+				return &SliceStringLiteral{Val: strs}, nil
+			}
+			return &SliceNumberLiteral{Val: nums}, nil
+		default:
+			return p.bad(p.errorf(pos, "Invalid array: unexpected %s", tokstr(tok, lit)))
+		}
+	}
 }
 
-// extract [variable] to variable
-// extract [variable][key1][key1] to variable.key1.key2
-// handle variable name which start with a "@"
-func (p *Parser) scanArg() (rune, string, error) {
-	var err error
-	var t rune
-	var tt string
-	var ttTmp string
-	var sep string
+// parseCallExpr parses the arguments of a function call and resolves
+// the function.
+func (p *Parser) parseCallExpr(name string, pos Pos) (Expr, error) {
+	var f *Function
+	if p.funcs != nil {
+		f, _ = p.funcs.Lookup(name)
+	}
+	if f == nil {
+		if err := p.report(p.errorf(pos, "Unknown function %s", name)); err != nil {
+			return nil, err
+		}
+	}
 
-	sep = ""
+	if tok, _ := p.scan(); tok != LPAREN {
+		return p.badOperand(p.unexpected(LPAREN.String()))
+	}
+	call := &CallExpr{Name: name, Arguments: []Expr{}, Func: f}
+
+	if tok, _ := p.scan(); tok == RPAREN {
+		return p.checkCall(call, pos)
+	}
+	p.unscan()
 
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	p.nest = append(p.nest, FUNC)
+	defer func() {
+		p.nest = p.nest[:len(p.nest)-1]
+		p.leave()
+	}()
 	for {
-		t, ttTmp = p.scan()
-		tt = tt + sep + ttTmp
-		if t == '@' {
-			continue
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
 		}
-		t, _ := p.scan()
-		if t == ']' {
-			ti, _ := p.scan()
-			if ti == '[' {
-				sep = "."
-				continue
-			} else {
-				p.unscan()
+		call.Arguments = append(call.Arguments, arg)
+
+		switch tok, _ := p.scan(); tok {
+		case COMMA:
+			continue
+		case RPAREN:
+			return p.checkCall(call, pos)
+		default:
+			if err := p.report(p.unexpected("operator", COMMA.String(), RPAREN.String())); err != nil {
+				return nil, err
 			}
-			return t, tt, nil
+			p.unscan()
+			return call, nil
 		}
+	}
+}
 
-		if t != ']' {
-			return t, tt, fmt.Errorf("Args error")
+// checkCall checks the arguments of a call against the signature of the
+// function. In recovery mode the call is kept, even if it is invalid.
+func (p *Parser) checkCall(call *CallExpr, pos Pos) (Expr, error) {
+	if call.Func == nil {
+		return call, nil
+	}
+	if err := call.Func.checkArgs(call.Arguments); err != nil {
+		if err := p.report(p.errorf(pos, "%s", err)); err != nil {
+			return nil, err
 		}
 	}
-
-	return t, tt, err
+	return call, nil
 }
 
 func Variables(expression Expr) []string {
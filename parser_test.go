@@ -1,6 +1,8 @@
 package conditions
 
 import (
+	"errors"
+	"math"
 	"strings"
 	"testing"
 
@@ -10,11 +12,23 @@ import (
 var invalidTestData = []string{
 	"",
 	// "[] AND true",
-	"A",
-	"[var0] == DEMO",
-	"[var0] == 'DEMO'",
-	"![var0]",
+	"A B",
+	"[var0] == #",
+	"[var0] == 'DEMO",
+	"[var0",
+	"[var0][",
+	"[var0] in [1, 2",
+	"[var0] in [1, 2,]",
+	"[var0] in [\"a\", 1]",
+	"[var0] =~ /abc",
+	"TIME",
+	"NOT",
+	"[var0] AND NOT",
 	"[var0] <> `DEMO`",
+	"[var0] in [+\"a\"]",
+	"EXISTS 1",
+	"EXISTS ([var0])",
+	"[var0] + 1 IS NULL",
 }
 
 var validTestData = []struct {
@@ -52,6 +66,51 @@ var validTestData = []struct {
 	{"[foo][dfs][a] == true and [bar] == true", map[string]interface{}{"foo.dfs.a": true, "bar": true}, true, false},
 	{"[@foo][a] == true and [bar] == true", map[string]interface{}{"@foo.a": true, "bar": true}, true, false},
 	{"[foo][unknow] == true and [bar] == true", map[string]interface{}{"foo.dfs": true, "bar": true}, false, true},
+	// precedence
+	{"true OR false AND false", nil, true, false},
+	{"false AND true OR true", nil, true, false},
+	{"false AND false OR true AND true", nil, true, false},
+	{"[var0] > 1 AND [var1] == \"ON\" AND [var2] in [1,2]", map[string]interface{}{"var0": 2, "var1": "ON", "var2": 2}, true, false},
+
+	// arithmetic
+	{"1 + 2 * 3 == 7", nil, true, false},
+	{"(1 + 2) * 3 == 9", nil, true, false},
+	{"10 - 2 - 3 == 5", nil, true, false},
+	{"12 / 2 / 3 == 2", nil, true, false},
+	{"7 % 4 == 3", nil, true, false},
+	{"[a] -5 == 1", map[string]interface{}{"a": 6}, true, false},
+	{"[a] - -5 == 11", map[string]interface{}{"a": 6}, true, false},
+	{"[used] / [total] > 0.9", map[string]interface{}{"used": 95, "total": 100}, true, false},
+	{"[a] + [b] >= 100", map[string]interface{}{"a": 40, "b": 50}, false, false},
+	{"[a] / 0 > 1", map[string]interface{}{"a": 1}, false, true},
+	{"[a] % 0 > 1", map[string]interface{}{"a": 1}, false, true},
+	{"[a] + 1 > 1", map[string]interface{}{"a": "1"}, false, true},
+	{"[a] + 1", map[string]interface{}{"a": 1}, false, true},
+
+	// NOT
+	{"NOT true", nil, false, false},
+	{"not false", nil, true, false},
+	{"![var0]", map[string]interface{}{"var0": false}, true, false},
+	{"!![var0]", map[string]interface{}{"var0": false}, false, false},
+	{"NOT ([a] AND [b])", map[string]interface{}{"a": true, "b": false}, true, false},
+	{"NOT [a] AND [b]", map[string]interface{}{"a": true, "b": true}, false, false},
+	{"!([a] > 5) OR [b]", map[string]interface{}{"a": 3, "b": false}, true, false},
+	{"[a] == 1 AND ![b]", map[string]interface{}{"a": 1, "b": false}, true, false},
+	{"NOT [a]", map[string]interface{}{"a": 1}, false, true},
+	{"NOT [a] == 1", map[string]interface{}{"a": 2}, true, false},
+	{"NOT [a] + 1 == 2 AND [b]", map[string]interface{}{"a": 2, "b": true}, true, false},
+	{"NOT [a] IN [1, 2] OR false", map[string]interface{}{"a": 3}, true, false},
+	{"NOT [a] =~ /x/", map[string]interface{}{"a": "x"}, false, false},
+	{"(NOT [a]) == 1", map[string]interface{}{"a": true}, false, true},
+	{"[foo] not in [2,3,4]", map[string]interface{}{"foo": 5}, true, false},
+
+	// short-circuit
+	{"false AND [missing]", nil, false, false},
+	{"true OR [missing]", nil, true, false},
+	{"false NAND [missing]", nil, true, false},
+	{"true AND [missing]", nil, false, true},
+	{"false OR [missing]", nil, false, true},
+	{"[user] != \"\" AND [user] =~ /^adm/", map[string]interface{}{"user": ""}, false, false},
 	//XOR
 	{"false XOR false", nil, false, false},
 	{"false xor true", nil, true, false},
@@ -86,6 +145,18 @@ var validTestData = []struct {
 	{`[foo] not in [2,3,4]`, map[string]interface{}{"foo": 4}, false, false},
 	{`[foo] not in [2,3,4]`, map[string]interface{}{"foo": 5}, true, false},
 
+	// quoting and lexing
+	{"[var0] == 'DEMO'", map[string]interface{}{"var0": "DEMO"}, true, false},
+	{"[var0] == `DEMO`", map[string]interface{}{"var0": "DEMO"}, true, false},
+	{`[var0] == "say \"hi\""`, map[string]interface{}{"var0": `say "hi"`}, true, false},
+	{`[var0] == 'it\'s'`, map[string]interface{}{"var0": "it's"}, true, false},
+	{"DEMO == 'x' AND var0 > 1", map[string]interface{}{"DEMO": "x", "var0": 2}, true, false},
+	{"[var0] == 1e3 AND [var1] == 2.5E-1", map[string]interface{}{"var0": 1000, "var1": 0.25}, true, false},
+	{"[var0] in ['a', \"b]\"]", map[string]interface{}{"var0": "b]"}, true, false},
+	{"[var0] in [-1, .5]", map[string]interface{}{"var0": 0.5}, true, false},
+	{"[a][0][b] == 1", map[string]interface{}{"a.0.b": 1}, true, false},
+	{"$0 > 1", map[string]interface{}{"$0": 2}, true, false},
+
 	// =~
 	{"[status] =~ /^5\\d\\d/", map[string]interface{}{"status": "500"}, true, false},
 	{"[status] =~ /^4\\d\\d/", map[string]interface{}{"status": "500"}, false, false},
@@ -93,6 +164,40 @@ var validTestData = []struct {
 	// !~
 	{"[status] !~ /^5\\d\\d/", map[string]interface{}{"status": "500"}, false, false},
 	{"[status] !~ /^4\\d\\d/", map[string]interface{}{"status": "500"}, true, false},
+
+	// A single unquoted name is a variable, even a number
+	{"[1] == 2 AND [1abc][0] == 3", map[string]interface{}{"1": 2, "1abc": []interface{}{3}}, true, false},
+	{"2 IN [+2] AND -1 IN [-1] AND 2 IN [1, 2]", nil, true, false},
+
+	// No ordered comparison holds for NaN
+	{"[var0] >= 5 OR [var0] <= 5 OR [var0] > 5 OR [var0] < 5", map[string]interface{}{"var0": math.NaN()}, false, false},
+	{"NOT ([var0] < 5)", map[string]interface{}{"var0": math.NaN()}, true, false},
+
+	// EXISTS, IS NULL and IS NOT NULL
+	{"EXISTS [var0] AND NOT EXISTS [var1]", map[string]interface{}{"var0": nil}, true, false},
+	{"[var0] IS NULL OR [var0] > 1", nil, true, false},
+	{"[var0] IS NOT NULL AND [var0] > 1", map[string]interface{}{"var0": 2}, true, false},
+	{"NOT [var0] IS NULL == true", map[string]interface{}{"var0": 2}, true, false},
+}
+
+func TestNotPrecedence(t *testing.T) {
+	a, one := &VarRef{Val: "a", Path: []string{"a"}}, &NumberLiteral{Val: 1}
+	data := []struct {
+		cond string
+		want Expr
+	}{
+		// NOT applies to the comparison following it, as in SQL.
+		{`NOT [a] == 1`, &UnaryExpr{Op: NOT, Expr: &BinaryExpr{Op: EQ, LHS: a, RHS: one}}},
+		{`![a] + 1 > 1`, &UnaryExpr{Op: NOT, Expr: &BinaryExpr{Op: GT, LHS: &BinaryExpr{Op: ADD, LHS: a, RHS: one}, RHS: one}}},
+		{`NOT [a] AND [a]`, &BinaryExpr{Op: AND, LHS: &UnaryExpr{Op: NOT, Expr: a}, RHS: a}},
+		{`(NOT [a]) == 1`, &BinaryExpr{Op: EQ, LHS: &ParenExpr{Expr: &UnaryExpr{Op: NOT, Expr: a}}, RHS: one}},
+	}
+	for _, td := range data {
+		expr, err := NewParser(strings.NewReader(td.cond)).Parse()
+		if assert.Nil(t, err, td.cond) {
+			assert.Equal(t, td.want, expr, td.cond)
+		}
+	}
 }
 
 func TestInvalid(t *testing.T) {
@@ -209,3 +314,173 @@ func TestExpressionsVariableNames(t *testing.T) {
 	assert.NotContains(t, args, "foo", "...")
 	assert.NotContains(t, args, "@foo", "...")
 }
+
+func TestParseErrorPositions(t *testing.T) {
+	data := []struct {
+		cond     string
+		pos      Pos
+		found    string
+		expected string
+		message  string
+	}{
+		{"[var0] == #", Pos{Offset: 10, Line: 1, Column: 11}, "#", "NUMBER", ""},
+		{"[a] AND", Pos{Offset: 7, Line: 1, Column: 8}, "EOF", "(", ""},
+		{"([a] AND [b]", Pos{Offset: 12, Line: 1, Column: 13}, "EOF", ")", ""},
+		{"[a] == 1 [b]", Pos{Offset: 9, Line: 1, Column: 10}, "b", "EOF", ""},
+		{"[a] ==\n  1 )", Pos{Offset: 11, Line: 2, Column: 5}, ")", "EOF", ""},
+		{"[var0] == 'DEMO", Pos{Offset: 10, Line: 1, Column: 11}, "", "", "Unterminated string"},
+		{"[a] AND [b", Pos{Offset: 8, Line: 1, Column: 9}, "", "", "Unterminated variable reference"},
+		{"[a] IN [1, 2", Pos{Offset: 7, Line: 1, Column: 8}, "", "", "Unterminated array"},
+		{"[a] =~ /abc", Pos{Offset: 7, Line: 1, Column: 8}, "", "", "Unterminated regular expression"},
+		{"[a] > TIME \"nope\"", Pos{Offset: 6, Line: 1, Column: 7}, "", "", "Invalid time"},
+	}
+
+	for _, td := range data {
+		expr, err := NewParser(strings.NewReader(td.cond)).Parse()
+		assert.Nil(t, expr, td.cond)
+		perr, ok := err.(*ParseError)
+		if !assert.True(t, ok, td.cond) {
+			continue
+		}
+		assert.Equal(t, td.pos, perr.Pos, td.cond)
+		if td.message != "" {
+			assert.Contains(t, perr.Message, td.message, td.cond)
+			continue
+		}
+		assert.Equal(t, td.found, perr.Found, td.cond)
+		assert.Contains(t, perr.Expected, td.expected, td.cond)
+	}
+}
+
+func TestParseErrorSnippet(t *testing.T) {
+	_, err := NewParser(strings.NewReader("[a] > 1 AND\n\t[b] == #")).Parse()
+	assert.NotNil(t, err)
+	assert.Equal(t, "\t[b] == #\n\t       ^", err.(*ParseError).Snippet())
+	assert.Contains(t, err.Error(), "found #, expected (, NOT")
+	assert.Contains(t, err.Error(), "at line 2, column 9\n\t[b] == #\n\t       ^")
+}
+
+func TestParseWithRecovery(t *testing.T) {
+	data := []struct {
+		cond string
+		expr string
+		errs []Pos
+	}{
+		{`[a] > 1 AND [b] == "x"`, `[a] > 1 AND [b] == "x"`, nil},
+		{`[a] == # AND [b] > AND [c]`, `[a] == <bad expression> AND [b] > <bad expression> AND [c]`, []Pos{
+			{Offset: 7, Line: 1, Column: 8},
+			{Offset: 19, Line: 1, Column: 20},
+		}},
+		{`([a] > 1 OR ) AND [b] == 1 2`, `([a] > 1 OR <bad expression>) AND [b] == 1`, []Pos{
+			{Offset: 12, Line: 1, Column: 13},
+			{Offset: 27, Line: 1, Column: 28},
+		}},
+		{`([a] == 1 AND NOT`, `[a] == 1 AND NOT <bad expression>`, []Pos{
+			{Offset: 17, Line: 1, Column: 18},
+		}},
+		{`[a] == 1) OR [b]`, `[a] == 1 OR [b]`, []Pos{
+			{Offset: 8, Line: 1, Column: 9},
+		}},
+		{`foo([a], #) AND [b] =~ /x`, `foo([a], <bad expression>) AND [b] =~ <bad expression>`, []Pos{
+			{Offset: 0, Line: 1, Column: 1},
+			{Offset: 9, Line: 1, Column: 10},
+			{Offset: 23, Line: 1, Column: 24},
+		}},
+	}
+
+	for _, td := range data {
+		expr, errs := NewParser(strings.NewReader(td.cond)).ParseWithRecovery()
+		if !assert.NotNil(t, expr, td.cond) {
+			continue
+		}
+		assert.Equal(t, td.expr, expr.String(), td.cond)
+		pos := []Pos{}
+		for _, err := range errs {
+			pos = append(pos, err.Pos)
+		}
+		if td.errs == nil {
+			assert.Nil(t, errs, td.cond)
+			continue
+		}
+		assert.Equal(t, td.errs, pos, td.cond)
+
+		// Error nodes cannot be evaluated.
+		if strings.Contains(td.expr, "<bad expression>") {
+			_, err := Evaluate(expr, map[string]interface{}{"a": 1, "b": 1, "c": true})
+			assert.NotNil(t, err, td.cond)
+		}
+	}
+}
+
+func TestParserOptions(t *testing.T) {
+	data := []struct {
+		cond string
+		opts ParserOptions
+		err  error
+		pos  Pos
+	}{
+		{`[a] == 1`, ParserOptions{MaxLength: 8}, nil, Pos{}},
+		{`[a] == 1`, ParserOptions{MaxLength: 7}, ErrSourceTooLong, Pos{Offset: 7, Line: 1, Column: 8}},
+		{"[a] == 1 AND\n[b]", ParserOptions{MaxLength: 15}, ErrSourceTooLong, Pos{Offset: 15, Line: 2, Column: 3}},
+
+		{`((NOT [a]))`, ParserOptions{MaxDepth: 3}, nil, Pos{}},
+		{`(((NOT [a])))`, ParserOptions{MaxDepth: 3}, ErrNestingTooDeep, Pos{Offset: 3, Line: 1, Column: 4}},
+		{`(max(max([a], 1), 1) > 1)`, ParserOptions{MaxDepth: 2}, ErrNestingTooDeep, Pos{Offset: 9, Line: 1, Column: 10}},
+
+		{`[a] IN ["x", "y"]`, ParserOptions{MaxArrayElements: 2}, nil, Pos{}},
+		{`[a] IN [1, 2, 3]`, ParserOptions{MaxArrayElements: 2}, ErrArrayTooLarge, Pos{Offset: 7, Line: 1, Column: 8}},
+
+		// Operands, operators, parentheses and NOT are nodes.
+		{`([a] == 1) AND NOT [b]`, ParserOptions{MaxNodes: 7}, nil, Pos{}},
+		{`([a] == 1) AND NOT [b]`, ParserOptions{MaxNodes: 6}, ErrTooManyNodes, Pos{Offset: 19, Line: 1, Column: 20}},
+
+		// The nesting depth is limited by default.
+		{strings.Repeat("(", DefaultMaxDepth) + "[a]" + strings.Repeat(")", DefaultMaxDepth), ParserOptions{}, nil, Pos{}},
+		{strings.Repeat("(", DefaultMaxDepth+1) + "[a]" + strings.Repeat(")", DefaultMaxDepth+1), ParserOptions{}, ErrNestingTooDeep,
+			Pos{Offset: DefaultMaxDepth, Line: 1, Column: DefaultMaxDepth + 1}},
+	}
+
+	for _, td := range data {
+		p := NewParserWithOptions(strings.NewReader(td.cond), td.opts)
+		p.SetFunctions(testFunctions(t))
+		_, err := p.Parse()
+		if td.err == nil {
+			assert.Nil(t, err, td.cond)
+			continue
+		}
+		perr, ok := err.(*ParseError)
+		if !assert.True(t, ok, td.cond) {
+			continue
+		}
+		assert.True(t, errors.Is(err, td.err), td.cond)
+		assert.Equal(t, td.pos, perr.Pos, td.cond)
+
+		// Exceeding a limit stops the recovery too.
+		p = NewParserWithOptions(strings.NewReader(td.cond), td.opts)
+		p.SetFunctions(testFunctions(t))
+		_, errs := p.ParseWithRecovery()
+		if assert.Len(t, errs, 1, td.cond) {
+			assert.True(t, errors.Is(errs[0], td.err), td.cond)
+		}
+	}
+}
+
+func TestBadExprRejected(t *testing.T) {
+	// The bad node is not reached by the evaluation.
+	expr, errs := NewParser(strings.NewReader(`false AND [b] >`)).ParseWithRecovery()
+	if !assert.Len(t, errs, 1) {
+		return
+	}
+	_, err := Evaluate(expr, nil)
+	assert.NotNil(t, err)
+	_, _, err = EvaluateWithTrace(expr, nil)
+	assert.NotNil(t, err)
+	_, err = Explain(expr, nil)
+	assert.NotNil(t, err)
+	_, err = Compile(expr)
+	assert.NotNil(t, err)
+
+	optimized, rewrites := OptimizeWithReport(expr)
+	assert.Equal(t, expr, optimized)
+	assert.Nil(t, rewrites)
+}
@@ -0,0 +1,567 @@
+package conditions
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// kind enumerates the types of values a Program operates on.
+type kind uint8
+
+const (
+	kindInvalid kind = iota
+	kindBoolean
+	kindNumber
+	kindString
+	kindSliceString
+	kindSliceNumber
+	kindTime
+	kindDuration
+	kindNull
+)
+
+// value is the unboxed result of a compiled node. It is passed around by
+// value so that evaluating a Program does not touch the heap.
+type value struct {
+	kind kind
+	b    bool
+	n    float64
+	s    string
+	ss   []string
+	ns   []float64
+	t    time.Time
+	d    time.Duration
+}
+
+// evalFunc is a compiled node of the expression tree.
+type evalFunc func(args map[string]interface{}) (value, error)
+
+// binaryFunc applies a binary operator to already evaluated operands.
+type binaryFunc func(l, r value) (value, error)
+
+// Program is an expression compiled into a tree of closures. Operators and
+// literal values are resolved once by Compile, so a Program can be evaluated
+// repeatedly without allocating. A Program is safe for concurrent use.
+type Program struct {
+	expr Expr
+	root evalFunc
+}
+
+// Compile resolves operators and literals of the given expression and
+// returns a Program that gives the same results as Evaluate.
+func Compile(expr Expr) (*Program, error) {
+	return CompileWithOptions(expr, Options{})
+}
+
+// CompileWithOptions compiles the expression into a Program that gives the
+// same results as EvaluateWithOptions with the given options.
+func CompileWithOptions(expr Expr, opts Options) (*Program, error) {
+	if expr == nil {
+		return nil, fmt.Errorf("Provided expression is nil")
+	}
+	if opts.MaxSteps > 0 {
+		return nil, ErrStepsNotSupported
+	}
+	c := &compiler{opts: opts}
+	root, err := c.compileExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &Program{expr: expr, root: root}, nil
+}
+
+// compiler holds the options the expression is compiled with.
+type compiler struct {
+	opts Options
+}
+
+// Expr returns the expression the program was compiled from.
+func (p *Program) Expr() Expr { return p.expr }
+
+// Evaluate runs the program using given args
+func (p *Program) Evaluate(args map[string]interface{}) (bool, error) {
+	v, err := p.root(args)
+	if err != nil {
+		return false, err
+	}
+	if v.kind == kindNull {
+		return false, nil
+	}
+	if v.kind != kindBoolean {
+		return false, fmt.Errorf("Unexpected result of the root expression: %s", p.expr)
+	}
+	return v.b, nil
+}
+
+// compileExpr compiles given expr recursively
+func (c *compiler) compileExpr(expr Expr) (evalFunc, error) {
+	switch n := expr.(type) {
+	case *ParenExpr:
+		return c.compileExpr(n.Expr)
+	case *BinaryExpr:
+		return c.compileBinaryExpr(n)
+	case *UnaryExpr:
+		return c.compileUnaryExpr(n)
+	case *CallExpr:
+		return c.compileCallExpr(n)
+	case *VarRef:
+		return c.compileVarRef(n), nil
+	case *BooleanLiteral, *NumberLiteral, *StringLiteral, *RegexLiteral, *SliceStringLiteral,
+		*SliceNumberLiteral, *TimeLiteral, *DurationLiteral:
+		return constant(literalToValue(n)), nil
+	case *BadExpr:
+		return nil, fmt.Errorf("Cannot compile an expression with syntax errors")
+	case nil:
+		return nil, fmt.Errorf("Provided expression is nil")
+	}
+	return nil, fmt.Errorf("Unsupported expression: %s", expr)
+}
+
+// constant returns a compiled node which always yields v
+func constant(v value) evalFunc {
+	return func(map[string]interface{}) (value, error) { return v, nil }
+}
+
+// compileVarRef compiles a lookup of the referenced argument
+func (c *compiler) compileVarRef(n *VarRef) evalFunc {
+	name, mode, missing := n.Val, c.opts.Lookup, c.opts.Missing
+	return func(args map[string]interface{}) (value, error) {
+		arg, ok := lookup(args, n, mode)
+		if (!ok || arg == nil) && missing != MissingError {
+			return value{kind: kindNull}, nil
+		}
+		if !ok {
+			return value{}, fmt.Errorf("argument: %v not found", name)
+		}
+		return toValue(name, arg)
+	}
+}
+
+// toValue converts an argument to the value representation
+func toValue(name string, arg interface{}) (value, error) {
+	switch a := arg.(type) {
+	case int:
+		return value{kind: kindNumber, n: float64(a)}, nil
+	case int32:
+		return value{kind: kindNumber, n: float64(a)}, nil
+	case int64:
+		return value{kind: kindNumber, n: float64(a)}, nil
+	case float32:
+		return value{kind: kindNumber, n: float64(a)}, nil
+	case float64:
+		return value{kind: kindNumber, n: a}, nil
+	case string:
+		return value{kind: kindString, s: a}, nil
+	case bool:
+		return value{kind: kindBoolean, b: a}, nil
+	case []string:
+		return value{kind: kindSliceString, ss: a}, nil
+	case []float64:
+		return value{kind: kindSliceNumber, ns: a}, nil
+	case []interface{}:
+		s, err := sliceArg(name, a)
+		if err != nil {
+			return value{}, err
+		}
+		return toValue(name, s)
+	case time.Time:
+		return value{kind: kindTime, t: a}, nil
+	case time.Duration:
+		return value{kind: kindDuration, d: a}, nil
+	}
+	return value{}, fmt.Errorf("Unsupported argument %s type: %T", name, arg)
+}
+
+// compileUnaryExpr compiles the operand and binds the operator
+func (c *compiler) compileUnaryExpr(n *UnaryExpr) (evalFunc, error) {
+	if isPresence(n.Op) {
+		return c.compilePresence(n)
+	}
+	operand, err := c.compileExpr(n.Expr)
+	if err != nil {
+		return nil, err
+	}
+	if n.Op != NOT {
+		return nil, fmt.Errorf("Unsupported operator: %s", n.Op)
+	}
+	return func(args map[string]interface{}) (value, error) {
+		v, err := operand(args)
+		if err != nil {
+			return value{}, err
+		}
+		if v.kind == kindNull {
+			return boolValue(true), nil
+		}
+		if v.kind != kindBoolean {
+			return value{}, fmt.Errorf("Literal is not a boolean: %s", v)
+		}
+		return boolValue(!v.b), nil
+	}, nil
+}
+
+// compilePresence compiles a test of the variable of a presence operator
+func (c *compiler) compilePresence(n *UnaryExpr) (evalFunc, error) {
+	ref, err := presenceRef(n)
+	if err != nil {
+		return nil, err
+	}
+	op, mode := n.Op, c.opts.Lookup
+	return func(args map[string]interface{}) (value, error) {
+		v, ok := lookup(args, ref, mode)
+		return boolValue(presence(op, v, ok)), nil
+	}, nil
+}
+
+// compileCallExpr compiles the arguments of a call. Calling a function
+// allocates, so programs using them are not allocation-free.
+func (c *compiler) compileCallExpr(n *CallExpr) (evalFunc, error) {
+	if n.Func == nil {
+		return nil, fmt.Errorf("Unknown function %s", n.Name)
+	}
+	if err := n.Func.checkArgs(n.Arguments); err != nil {
+		return nil, err
+	}
+	operands := make([]evalFunc, len(n.Arguments))
+	for i, arg := range n.Arguments {
+		fn, err := c.compileExpr(arg)
+		if err != nil {
+			return nil, err
+		}
+		operands[i] = fn
+	}
+	f, name := n.Func, n.Name
+	return func(args map[string]interface{}) (value, error) {
+		values := make([]interface{}, len(operands))
+		for i, operand := range operands {
+			v, err := operand(args)
+			if err != nil {
+				return value{}, err
+			}
+			values[i] = v.interfaceValue()
+		}
+		result, err := f.Call(values)
+		if err != nil {
+			return value{}, err
+		}
+		return toValue(name, result)
+	}, nil
+}
+
+// compileBinaryExpr compiles both operands and binds the operator
+func (c *compiler) compileBinaryExpr(n *BinaryExpr) (evalFunc, error) {
+	lhs, err := c.compileExpr(n.LHS)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := c.compileExpr(n.RHS)
+	if err != nil {
+		return nil, err
+	}
+
+	var op binaryFunc
+	switch n.Op {
+	case EREG, NEREG:
+		op, err = compileRegexOperator(n.Op, n.RHS, c.opts.MaxRegexInput)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		op = binaryOperators[n.Op]
+		if op == nil {
+			return nil, fmt.Errorf("Unsupported operator: %s", n.Op)
+		}
+	}
+	if c.opts.Missing != MissingError {
+		op = nullOperator(n.Op, op, c.opts.Missing)
+	}
+
+	// AND, OR and NAND skip the right operand once the left one decides
+	// the result.
+	var (
+		decisive bool
+		decided  value
+	)
+	switch n.Op {
+	case AND:
+		decisive, decided = false, boolValue(false)
+	case OR:
+		decisive, decided = true, boolValue(true)
+	case NAND:
+		decisive, decided = false, boolValue(true)
+	}
+
+	return func(args map[string]interface{}) (value, error) {
+		l, err := lhs(args)
+		if err != nil {
+			return value{}, err
+		}
+		// A null boolean operand is false.
+		if decided.kind == kindBoolean && (l.kind == kindBoolean && l.b == decisive || l.kind == kindNull && !decisive) {
+			return decided, nil
+		}
+		r, err := rhs(args)
+		if err != nil {
+			return value{}, err
+		}
+		return op(l, r)
+	}, nil
+}
+
+// compileRegexOperator returns an EREG/NEREG operator. A pattern given
+// as a literal is compiled once here, patterns coming from arguments go
+// through the regex cache. Inputs longer than maxInput are rejected unless
+// it is 0.
+func compileRegexOperator(op Token, pattern Expr, maxInput int) (binaryFunc, error) {
+	negate := op == NEREG
+	var re *regexp.Regexp
+	switch lit := pattern.(type) {
+	case *RegexLiteral:
+		re = lit.Val
+	case *StringLiteral:
+		var err error
+		if re, err = regexp.Compile(lit.Val); err != nil {
+			return nil, err
+		}
+	}
+	if re != nil {
+		return func(l, r value) (value, error) {
+			if l.kind != kindString {
+				return value{}, fmt.Errorf("Literal is not a string: %s", l)
+			}
+			if maxInput > 0 && len(l.s) > maxInput {
+				return value{}, ErrRegexInputTooLong
+			}
+			return boolValue(re.MatchString(l.s) != negate), nil
+		}, nil
+	}
+	return func(l, r value) (value, error) {
+		if l.kind != kindString {
+			return value{}, fmt.Errorf("Literal is not a string: %s", l)
+		}
+		if r.kind != kindString {
+			return value{}, fmt.Errorf("Literal is not a string: %s", r)
+		}
+		if maxInput > 0 && len(l.s) > maxInput {
+			return value{}, ErrRegexInputTooLong
+		}
+		re, err := patterns.compile(r.s)
+		if err != nil {
+			return value{}, err
+		}
+		return boolValue(re.MatchString(l.s) != negate), nil
+	}, nil
+}
+
+// binaryOperators maps operator tokens to their implementations
+var binaryOperators = map[Token]binaryFunc{
+	AND:   logicalOperator(func(a, b bool) bool { return a && b }),
+	OR:    logicalOperator(func(a, b bool) bool { return a || b }),
+	XOR:   logicalOperator(func(a, b bool) bool { return a != b }),
+	NAND:  logicalOperator(func(a, b bool) bool { return !(a && b) }),
+	EQ:    equalityOperator(false),
+	NEQ:   equalityOperator(true),
+	GT:    orderedOperator(func(c int) bool { return c > 0 }),
+	GTE:   orderedOperator(func(c int) bool { return c >= 0 }),
+	LT:    orderedOperator(func(c int) bool { return c < 0 }),
+	LTE:   orderedOperator(func(c int) bool { return c <= 0 }),
+	IN:    inOperator(false),
+	NOTIN: inOperator(true),
+	ADD:   arithmeticOperator(ADD),
+	SUB:   arithmeticOperator(SUB),
+	MUL:   arithmeticOperator(MUL),
+	DIV:   arithmeticOperator(DIV),
+	MOD:   arithmeticOperator(MOD),
+}
+
+func boolValue(b bool) value { return value{kind: kindBoolean, b: b} }
+
+// logicalOperator builds an operator over two booleans
+func logicalOperator(fn func(a, b bool) bool) binaryFunc {
+	return func(l, r value) (value, error) {
+		if l.kind != kindBoolean {
+			return value{}, fmt.Errorf("Literal is not a boolean: %s", l)
+		}
+		if r.kind != kindBoolean {
+			return value{}, fmt.Errorf("Literal is not a boolean: %s", r)
+		}
+		return boolValue(fn(l.b, r.b)), nil
+	}
+}
+
+// orderedOperator builds a comparison of two numbers, times or durations
+func orderedOperator(fn func(c int) bool) binaryFunc {
+	return func(l, r value) (value, error) {
+		c, err := compareValues(l, r)
+		if err != nil {
+			return value{}, err
+		}
+		return boolValue(c != unordered && fn(c)), nil
+	}
+}
+
+// arithmeticOperator builds an arithmetic operation on two numbers
+func arithmeticOperator(op Token) binaryFunc {
+	return func(l, r value) (value, error) {
+		if l.kind == kindTime || l.kind == kindDuration || r.kind == kindTime || r.kind == kindDuration {
+			return timeArithmetic(op, l, r)
+		}
+		if l.kind != kindNumber {
+			return value{}, fmt.Errorf("Cannot apply %s to non-number: %s", op, l)
+		}
+		if r.kind != kindNumber {
+			return value{}, fmt.Errorf("Cannot apply %s to non-number: %s", op, r)
+		}
+		n, err := arithmetic(op, l.n, r.n)
+		if err != nil {
+			return value{}, err
+		}
+		return value{kind: kindNumber, n: n}, nil
+	}
+}
+
+// equalityOperator builds == (or != when negate is set) following the
+// typing rules of applyEQ
+func equalityOperator(negate bool) binaryFunc {
+	return func(l, r value) (value, error) {
+		var eq bool
+		switch l.kind {
+		case kindString:
+			if r.kind != kindString {
+				return value{}, fmt.Errorf("Cannot compare string with non-string")
+			}
+			eq = l.s == r.s
+		case kindNumber:
+			if r.kind != kindNumber {
+				return value{}, fmt.Errorf("Cannot compare number with non-number")
+			}
+			eq = l.n == r.n
+		case kindBoolean:
+			if r.kind != kindBoolean {
+				return value{}, fmt.Errorf("Cannot compare boolean with non-boolean")
+			}
+			eq = l.b == r.b
+		case kindTime:
+			if r.kind != kindTime {
+				return value{}, fmt.Errorf("Cannot compare time with non-time")
+			}
+			eq = l.t.Equal(r.t)
+		case kindDuration:
+			if r.kind != kindDuration {
+				return value{}, fmt.Errorf("Cannot compare duration with non-duration")
+			}
+			eq = l.d == r.d
+		default:
+			return boolValue(false), nil
+		}
+		return boolValue(eq != negate), nil
+	}
+}
+
+// inOperator builds IN (or NOT IN when negate is set)
+func inOperator(negate bool) binaryFunc {
+	return func(l, r value) (value, error) {
+		found := false
+		switch l.kind {
+		case kindString:
+			if r.kind != kindSliceString {
+				return value{}, fmt.Errorf("Literal is not a slice of string: %s", r)
+			}
+			for _, e := range r.ss {
+				if l.s == e {
+					found = true
+					break
+				}
+			}
+		case kindNumber:
+			// An empty array argument is a []string, it has no element type.
+			if r.kind != kindSliceNumber && (r.kind != kindSliceString || len(r.ss) > 0) {
+				return value{}, fmt.Errorf("Literal is not a slice of float64: %s", r)
+			}
+			for _, e := range r.ns {
+				if l.n == e {
+					found = true
+					break
+				}
+			}
+		default:
+			return value{}, fmt.Errorf("Can not evaluate Literal of unknow type %s", l)
+		}
+		return boolValue(found != negate), nil
+	}
+}
+
+// interfaceValue returns the value as a Go value.
+func (v value) interfaceValue() interface{} {
+	switch v.kind {
+	case kindBoolean:
+		return v.b
+	case kindNumber:
+		return v.n
+	case kindString:
+		return v.s
+	case kindSliceString:
+		return v.ss
+	case kindSliceNumber:
+		return v.ns
+	case kindTime:
+		return v.t
+	case kindDuration:
+		return v.d
+	}
+	return nil
+}
+
+// literalToValue converts a literal expression to a value
+func literalToValue(e Expr) value {
+	switch n := e.(type) {
+	case *BooleanLiteral:
+		return value{kind: kindBoolean, b: n.Val}
+	case *NumberLiteral:
+		return value{kind: kindNumber, n: n.Val}
+	case *StringLiteral:
+		return value{kind: kindString, s: n.Val}
+	case *RegexLiteral:
+		return value{kind: kindString, s: n.Val.String()}
+	case *SliceStringLiteral:
+		return value{kind: kindSliceString, ss: n.Val}
+	case *SliceNumberLiteral:
+		return value{kind: kindSliceNumber, ns: n.Val}
+	case *TimeLiteral:
+		return value{kind: kindTime, t: n.Val}
+	case *DurationLiteral:
+		return value{kind: kindDuration, d: n.Val}
+	}
+	return value{}
+}
+
+// literal returns the value as a literal expression.
+func (v value) literal() Expr {
+	switch v.kind {
+	case kindBoolean:
+		return &BooleanLiteral{Val: v.b}
+	case kindNumber:
+		return &NumberLiteral{Val: v.n}
+	case kindString:
+		return &StringLiteral{Val: v.s}
+	case kindSliceString:
+		return &SliceStringLiteral{Val: v.ss}
+	case kindSliceNumber:
+		return &SliceNumberLiteral{Val: v.ns}
+	case kindTime:
+		return &TimeLiteral{Val: v.t}
+	case kindDuration:
+		return &DurationLiteral{Val: v.d}
+	case kindNull:
+		return nullExpr
+	}
+	return nil
+}
+
+// String returns a string representation of the value.
+func (v value) String() string {
+	if l := v.literal(); l != nil {
+		return l.String()
+	}
+	return "<invalid>"
+}
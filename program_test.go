@@ -0,0 +1,94 @@
+package conditions
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgramMatchesEvaluate(t *testing.T) {
+	for _, td := range validTestData {
+		expr, err := NewParser(strings.NewReader(td.cond)).Parse()
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+
+		want, wantErr := Evaluate(expr, td.args)
+
+		prg, err := Compile(expr)
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+		got, gotErr := prg.Evaluate(td.args)
+
+		assert.Equal(t, wantErr != nil, gotErr != nil, td.cond)
+		assert.Equal(t, want, got, td.cond)
+	}
+}
+
+func TestCompileInvalidRegex(t *testing.T) {
+	_, err := NewParser(strings.NewReader("[status] =~ /^(5/")).Parse()
+	assert.NotNil(t, err)
+
+	expr, err := NewParser(strings.NewReader(`[status] =~ "^(5"`)).Parse()
+	assert.Nil(t, err)
+
+	_, err = Compile(expr)
+	assert.NotNil(t, err)
+}
+
+func TestProgramDoesNotAllocate(t *testing.T) {
+	prg, err := Compile(benchmarkExpr(t))
+	assert.Nil(t, err)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := prg.Evaluate(benchmarkArgs); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.Equal(t, 0.0, allocs)
+}
+
+const benchmarkCond = `([cpu] > 0.9 OR [mem] >= 1024) AND ([host] in ["a", "b", "c"]) AND ([status] =~ /^5\d\d/) AND ([enabled] == true)`
+
+var benchmarkArgs = map[string]interface{}{
+	"cpu":     0.95,
+	"mem":     512,
+	"host":    "b",
+	"status":  "503",
+	"enabled": true,
+}
+
+func benchmarkExpr(tb testing.TB) Expr {
+	expr, err := NewParser(strings.NewReader(benchmarkCond)).Parse()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return expr
+}
+
+func BenchmarkEvaluate(b *testing.B) {
+	expr := benchmarkExpr(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Evaluate(expr, benchmarkArgs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProgram(b *testing.B) {
+	prg, err := Compile(benchmarkExpr(b))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := prg.Evaluate(benchmarkArgs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
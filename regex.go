@@ -0,0 +1,177 @@
+package conditions
+
+import (
+	"container/list"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"sync"
+)
+
+// regexFlags are the flags accepted after a regex literal: case-insensitive,
+// multi-line and . matching new lines.
+const regexFlags = "ims"
+
+// RegexLimits bounds the size of regular expression literals. Zero values
+// mean no limit.
+type RegexLimits struct {
+	// MaxLength is the maximum length of a pattern in bytes
+	MaxLength int
+	// MaxProgramSize is the maximum number of instructions of the compiled
+	// pattern, repetitions such as (a{100}){100} are small patterns
+	// compiling to huge programs
+	MaxProgramSize int
+}
+
+// NewRegexLiteral compiles a pattern with its flags into a RegexLiteral,
+// checking it against the limits.
+func NewRegexLiteral(pattern, flags string, limits RegexLimits) (*RegexLiteral, error) {
+	for _, f := range flags {
+		if !strings.ContainsRune(regexFlags, f) {
+			return nil, fmt.Errorf("Unknown regular expression flag %c", f)
+		}
+	}
+	expr := pattern
+	if flags != "" {
+		expr = "(?" + flags + ")" + pattern
+	}
+	if err := limits.check(pattern, expr); err != nil {
+		return nil, err
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid regular expression: %s", err)
+	}
+	return &RegexLiteral{Pattern: pattern, Flags: flags, Val: re}, nil
+}
+
+// check checks a pattern, compiled as expr with its flags, against the
+// limits.
+func (l RegexLimits) check(pattern, expr string) error {
+	if l.MaxLength > 0 && len(pattern) > l.MaxLength {
+		return fmt.Errorf("Regular expression is too long: %d bytes, the limit is %d", len(pattern), l.MaxLength)
+	}
+	if l.MaxProgramSize > 0 {
+		re, err := syntax.Parse(expr, syntax.Perl)
+		if err != nil {
+			return fmt.Errorf("Invalid regular expression: %s", err)
+		}
+		prog, err := syntax.Compile(re.Simplify())
+		if err != nil {
+			return fmt.Errorf("Invalid regular expression: %s", err)
+		}
+		if len(prog.Inst) > l.MaxProgramSize {
+			return fmt.Errorf("Regular expression is too complex: %d instructions, the limit is %d", len(prog.Inst), l.MaxProgramSize)
+		}
+	}
+	return nil
+}
+
+// checkPattern checks the right operand of a =~ or !~ operation given as
+// a string against the limits, as the pattern of a regex literal.
+func (l RegexLimits) checkPattern(op Token, rhs Expr) error {
+	if op != EREG && op != NEREG {
+		return nil
+	}
+	for {
+		p, ok := rhs.(*ParenExpr)
+		if !ok {
+			break
+		}
+		rhs = p.Expr
+	}
+	if s, ok := rhs.(*StringLiteral); ok {
+		return l.check(s.Val, s.Val)
+	}
+	return nil
+}
+
+// DefaultRegexCacheSize is the number of compiled patterns kept by default.
+const DefaultRegexCacheSize = 256
+
+// patterns caches the regular expressions only known at evaluation time,
+// i.e. patterns given as strings or coming from arguments. Regex literals
+// are compiled by the parser.
+var patterns = newRegexCache(DefaultRegexCacheSize)
+
+// SetRegexCacheSize sets the maximum number of compiled patterns kept by
+// the cache, evicting the least recently used ones. A size of 0 disables
+// caching.
+func SetRegexCacheSize(size int) {
+	patterns.resize(size)
+}
+
+// regexCache is a LRU cache of compiled regular expressions.
+type regexCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // most recently used first
+}
+
+type regexEntry struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+func newRegexCache(size int) *regexCache {
+	return &regexCache{size: size, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+// compile returns the compiled pattern from the cache or compiles and
+// caches it. Invalid patterns are not cached.
+func (c *regexCache) compile(pattern string) (*regexp.Regexp, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[pattern]; ok {
+		c.order.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*regexEntry).re, nil
+	}
+	c.mu.Unlock()
+
+	// Compile outside of the lock, a concurrent compilation of the same
+	// pattern only costs the duplicated work.
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= 0 {
+		return re, nil
+	}
+	if e, ok := c.entries[pattern]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*regexEntry).re, nil
+	}
+	c.entries[pattern] = c.order.PushFront(&regexEntry{pattern: pattern, re: re})
+	c.evict()
+	return re, nil
+}
+
+// resize changes the capacity of the cache.
+func (c *regexCache) resize(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size = size
+	c.evict()
+}
+
+// evict drops the least recently used entries above the capacity.
+func (c *regexCache) evict() {
+	for c.order.Len() > 0 && c.order.Len() > c.size {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.entries, e.Value.(*regexEntry).pattern)
+	}
+}
+
+// len returns the number of cached patterns.
+func (c *regexCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
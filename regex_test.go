@@ -0,0 +1,182 @@
+package conditions
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegexLiteral(t *testing.T) {
+	expr, err := NewParser(strings.NewReader(`[status] =~ /^5\d\d$/`)).Parse()
+	if !assert.Nil(t, err) {
+		return
+	}
+	re, ok := expr.(*BinaryExpr).RHS.(*RegexLiteral)
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Equal(t, `^5\d\d$`, re.Val.String())
+	assert.Equal(t, `[status] =~ /^5\d\d$/`, expr.String())
+
+	_, err = NewParser(strings.NewReader(`[status] =~ /^(5/`)).Parse()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "Invalid regular expression")
+	}
+}
+
+func TestRegexCache(t *testing.T) {
+	c := newRegexCache(2)
+	a, err := c.compile("a")
+	assert.Nil(t, err)
+	_, err = c.compile("b")
+	assert.Nil(t, err)
+
+	// a is the most recently used, b is evicted
+	again, _ := c.compile("a")
+	assert.True(t, a == again)
+	_, err = c.compile("c")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, c.len())
+	_, cached := c.entries["b"]
+	assert.False(t, cached)
+
+	_, err = c.compile("(")
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, c.len())
+
+	c.resize(0)
+	assert.Equal(t, 0, c.len())
+	_, err = c.compile("d")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, c.len())
+}
+
+func TestRegexFromArgument(t *testing.T) {
+	expr, err := NewParser(strings.NewReader(`[line] =~ [pattern]`)).Parse()
+	if !assert.Nil(t, err) {
+		return
+	}
+	prg, err := Compile(expr)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	data := []struct {
+		pattern string
+		result  bool
+		isErr   bool
+	}{
+		{"^GET ", true, false},
+		{"^POST ", false, false},
+		{"^(GET", false, true},
+	}
+	args := map[string]interface{}{"line": "GET /index.html"}
+	for _, td := range data {
+		args["pattern"] = td.pattern
+		r, err := Evaluate(expr, args)
+		assert.Equal(t, td.isErr, err != nil, td.pattern)
+		assert.Equal(t, td.result, r, td.pattern)
+
+		r, err = prg.Evaluate(args)
+		assert.Equal(t, td.isErr, err != nil, td.pattern)
+		assert.Equal(t, td.result, r, td.pattern)
+	}
+}
+
+func TestRegexLiteralSyntax(t *testing.T) {
+	data := []struct {
+		cond   string
+		args   map[string]interface{}
+		result bool
+		str    string
+	}{
+		{`[payload] =~ /error/i`, map[string]interface{}{"payload": "An ERROR occurred"}, true, `[payload] =~ /error/i`},
+		{`[payload] =~ /error/`, map[string]interface{}{"payload": "An ERROR occurred"}, false, `[payload] =~ /error/`},
+		{`[path] =~ /^\/api\/v1\//`, map[string]interface{}{"path": "/api/v1/users"}, true, `[path] =~ /^\/api\/v1\//`},
+		{`[payload] =~ /a b  c/`, map[string]interface{}{"payload": "a b  c"}, true, `[payload] =~ /a b  c/`},
+		{`[payload] =~ /^b$/m`, map[string]interface{}{"payload": "a\nb\nc"}, true, `[payload] =~ /^b$/m`},
+		{`[payload] =~ /a.b/s`, map[string]interface{}{"payload": "a\nb"}, true, `[payload] =~ /a.b/s`},
+		{`[payload] =~ /a.b/is AND true`, map[string]interface{}{"payload": "A\nB"}, true, `[payload] =~ /a.b/is AND true`},
+		{`[payload] =~ /\\/`, map[string]interface{}{"payload": `a\b`}, true, `[payload] =~ /\\/`},
+	}
+
+	for _, td := range data {
+		expr, err := NewParser(strings.NewReader(td.cond)).Parse()
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+		assert.Equal(t, td.str, expr.String(), td.cond)
+		r, err := Evaluate(expr, td.args)
+		assert.Nil(t, err, td.cond)
+		assert.Equal(t, td.result, r, td.cond)
+
+		// The string representation parses back to the same pattern.
+		again, err := NewParser(strings.NewReader(expr.String())).Parse()
+		if assert.Nil(t, err, td.cond) {
+			assert.Equal(t, td.str, again.String(), td.cond)
+		}
+	}
+}
+
+func TestInvalidRegexLiterals(t *testing.T) {
+	data := []struct {
+		cond string
+		err  string
+	}{
+		{`[payload] =~ /error`, "Unterminated regular expression"},
+		{`[payload] =~ /error\/`, "Unterminated regular expression"},
+		{"[payload] =~ /err\nor/", "Unterminated regular expression"},
+		{`[payload] =~ /error/x`, "Unknown regular expression flag x"},
+		{`[payload] =~ /error/ii`, "Duplicate regular expression flag i"},
+		{`[payload] =~ /(error/`, "Invalid regular expression"},
+		{`[payload] =~ /error/ AND`, "found EOF"},
+	}
+	for _, td := range data {
+		_, err := NewParser(strings.NewReader(td.cond)).Parse()
+		if assert.NotNil(t, err, td.cond) {
+			assert.Contains(t, err.Error(), td.err, td.cond)
+		}
+	}
+}
+
+func TestRegexLimits(t *testing.T) {
+	data := []struct {
+		cond   string
+		limits RegexLimits
+		err    string
+	}{
+		{`[payload] =~ /abcdef/`, RegexLimits{MaxLength: 6}, ""},
+		{`[payload] =~ /abcdefg/`, RegexLimits{MaxLength: 6}, "Regular expression is too long: 7 bytes, the limit is 6"},
+		{`[payload] =~ /a{10}/`, RegexLimits{MaxProgramSize: 100}, ""},
+		{`[payload] =~ /(a{30}){30}/`, RegexLimits{MaxProgramSize: 100}, "Regular expression is too complex"},
+		{`[payload] =~ /(a{30}){30}/`, RegexLimits{}, ""},
+		{`[payload] =~ "abcdefg"`, RegexLimits{MaxLength: 6}, "Regular expression is too long: 7 bytes, the limit is 6 at line 1, column 14"},
+		{`[payload] !~ ("abcdefg")`, RegexLimits{MaxLength: 6}, "Regular expression is too long"},
+		{`[payload] =~ "(a{30}){30}"`, RegexLimits{MaxProgramSize: 100}, "Regular expression is too complex"},
+		{`[payload] =~ "(a{30}){30}"`, RegexLimits{}, ""},
+		{`[payload] == "abcdefg"`, RegexLimits{MaxLength: 6}, ""},
+	}
+	for _, td := range data {
+		p := NewParser(strings.NewReader(td.cond))
+		p.SetRegexLimits(td.limits)
+		_, err := p.Parse()
+		if td.err == "" {
+			assert.Nil(t, err, td.cond)
+		} else if assert.NotNil(t, err, td.cond) {
+			assert.Contains(t, err.Error(), td.err, td.cond)
+		}
+
+		// Decoded expressions are checked against the same limits.
+		expr, err := NewParser(strings.NewReader(td.cond)).Parse()
+		assert.Nil(t, err, td.cond)
+		data, err := MarshalExpr(expr)
+		assert.Nil(t, err, td.cond)
+		_, err = UnmarshalExprWithLimits(data, nil, td.limits)
+		if td.err == "" {
+			assert.Nil(t, err, td.cond)
+		} else if assert.NotNil(t, err, td.cond) {
+			assert.Contains(t, err.Error(), strings.TrimSuffix(td.err, " at line 1, column 14"), td.cond)
+		}
+	}
+}
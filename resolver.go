@@ -0,0 +1,148 @@
+package conditions
+
+import "fmt"
+
+// LookupMode selects how variable references are resolved against args.
+type LookupMode int
+
+const (
+	// LookupNested walks nested maps and slices one path segment at a
+	// time, [foo][0][bar] resolves args["foo"].([]interface{})[0]["bar"].
+	// When the path does not exist it falls back to the flat key.
+	LookupNested LookupMode = iota
+	// LookupFlat only looks up the flat key, [foo][bar] resolves
+	// args["foo.bar"].
+	LookupFlat
+)
+
+// MissingMode selects how variables missing from args are evaluated.
+type MissingMode int
+
+const (
+	// MissingError fails the evaluation on a missing variable.
+	MissingError MissingMode = iota
+	// MissingNull evaluates missing variables, and variables set to nil,
+	// to null. Null is only equal to null, other comparisons of null are
+	// false and their negations (!=, NOT IN, !~) true. Arithmetic on null
+	// gives null and a null boolean operand is false.
+	MissingNull
+	// MissingFalse evaluates missing variables, and variables set to nil,
+	// to null like MissingNull, but every comparison of null is false,
+	// including !=, NOT IN and !~.
+	MissingFalse
+)
+
+// Options controls the evaluation of expressions.
+type Options struct {
+	// Lookup is the variable resolution mode, LookupNested by default.
+	Lookup LookupMode
+	// MaxSteps limits the number of evaluation steps, a step per node and
+	// per element of an IN list, 0 for no limit. Programs do not count
+	// steps, CompileWithOptions rejects it.
+	MaxSteps int
+	// MaxRegexInput limits the length of the strings matched against
+	// regular expressions, 0 for no limit.
+	MaxRegexInput int
+	// Missing is the evaluation of missing variables, MissingError by
+	// default. EXISTS and IS [NOT] NULL test variables in all modes.
+	Missing MissingMode
+}
+
+// resolver resolves variable references to their values.
+type resolver interface {
+	resolve(ref *VarRef) (interface{}, bool)
+	// missingMode is the evaluation of unresolved variables
+	missingMode() MissingMode
+}
+
+// mapResolver resolves variable references against the args map.
+type mapResolver struct {
+	args    map[string]interface{}
+	mode    LookupMode
+	missing MissingMode
+}
+
+func (r *mapResolver) resolve(ref *VarRef) (interface{}, bool) {
+	return lookup(r.args, ref, r.mode)
+}
+
+func (r *mapResolver) missingMode() MissingMode { return r.missing }
+
+// lookup returns the value referenced by ref in args
+func lookup(args map[string]interface{}, ref *VarRef, mode LookupMode) (interface{}, bool) {
+	if mode == LookupNested && len(ref.Path) > 1 {
+		if v, ok := lookupPath(args, ref.Path); ok {
+			return v, true
+		}
+	}
+	v, ok := args[ref.Val]
+	return v, ok
+}
+
+// lookupPath walks nested maps and slices along the path. Numeric
+// segments are used as slice indexes.
+func lookupPath(args map[string]interface{}, path []string) (interface{}, bool) {
+	var cur interface{} = args
+	for _, seg := range path {
+		switch c := cur.(type) {
+		case map[string]interface{}:
+			v, ok := c[seg]
+			if !ok {
+				return nil, false
+			}
+			cur = v
+		case []interface{}:
+			i, ok := parseIndex(seg)
+			if !ok || i >= len(c) {
+				return nil, false
+			}
+			cur = c[i]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// parseIndex parses a path segment made of decimal digits only
+func parseIndex(seg string) (int, bool) {
+	if seg == "" || len(seg) > 9 {
+		return 0, false
+	}
+	i := 0
+	for _, c := range seg {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		i = i*10 + int(c-'0')
+	}
+	return i, true
+}
+
+// sliceArg converts an array as decoded by encoding/json to a []string or
+// a []float64, its elements must be all strings or all numbers. An empty
+// array is a []string.
+func sliceArg(name string, a []interface{}) (interface{}, error) {
+	var (
+		ss []string
+		ns []float64
+	)
+	for _, e := range a {
+		v, err := toValue(name, e)
+		switch {
+		case err == nil && v.kind == kindString && ns == nil:
+			ss = append(ss, v.s)
+		case err == nil && v.kind == kindNumber && ss == nil:
+			ns = append(ns, v.n)
+		default:
+			return nil, fmt.Errorf("Unsupported argument %s: arrays must hold only strings or only numbers, got %T", name, e)
+		}
+	}
+	if ns != nil {
+		return ns, nil
+	}
+	if ss == nil {
+		ss = []string{}
+	}
+	return ss, nil
+}
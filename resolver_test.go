@@ -0,0 +1,121 @@
+package conditions
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var nestedArgs = map[string]interface{}{
+	"user": map[string]interface{}{
+		"name": "admin",
+		"tags": []interface{}{"a", "b"},
+		"roles": []interface{}{
+			map[string]interface{}{"name": "ops", "level": 3},
+			map[string]interface{}{"name": "dev", "level": 1},
+		},
+	},
+	"flat.key": true,
+}
+
+func TestLookupModes(t *testing.T) {
+	data := []struct {
+		cond   string
+		mode   LookupMode
+		result bool
+		isErr  bool
+	}{
+		{`[user][name] == "admin"`, LookupNested, true, false},
+		{`[user][tags][1] == "b"`, LookupNested, true, false},
+		{`[user][roles][0][level] > 2`, LookupNested, true, false},
+		{`[user][roles][1][name] == "dev"`, LookupNested, true, false},
+		{`[user][roles][2][name] == "dev"`, LookupNested, false, true},
+		{`[user][roles][x][name] == "dev"`, LookupNested, false, true},
+		{`[user][name][0] == "a"`, LookupNested, false, true},
+		{`[flat][key]`, LookupNested, true, false},
+		{`[flat][key]`, LookupFlat, true, false},
+		{`[user][name] == "admin"`, LookupFlat, false, true},
+	}
+
+	for _, td := range data {
+		expr, err := NewParser(strings.NewReader(td.cond)).Parse()
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+		opts := Options{Lookup: td.mode}
+
+		r, err := EvaluateWithOptions(expr, nestedArgs, opts)
+		assert.Equal(t, td.isErr, err != nil, td.cond)
+		assert.Equal(t, td.result, r, td.cond)
+
+		prg, err := CompileWithOptions(expr, opts)
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+		r, err = prg.Evaluate(nestedArgs)
+		assert.Equal(t, td.isErr, err != nil, td.cond)
+		assert.Equal(t, td.result, r, td.cond)
+	}
+}
+
+func TestJSONDocumentArrays(t *testing.T) {
+	var args map[string]interface{}
+	doc := `{"doc": {"tags": ["a", "b"], "codes": [200, 404], "empty": [], "mixed": ["a", 1], "nested": [["a"]]}}`
+	if !assert.Nil(t, json.Unmarshal([]byte(doc), &args)) {
+		return
+	}
+
+	data := []struct {
+		cond   string
+		result bool
+		err    string
+	}{
+		{`"b" IN [doc][tags]`, true, ""},
+		{`"c" NOT IN [doc][tags]`, true, ""},
+		{`404 IN [doc][codes]`, true, ""},
+		{`"a" IN [doc][empty] OR 1 IN [doc][empty]`, false, ""},
+		{`1 NOT IN [doc][empty]`, true, ""},
+		{`"a" IN [doc][codes]`, false, "Literal is not a slice of string"},
+		{`"a" IN [doc][mixed]`, false, "arrays must hold only strings or only numbers, got float64"},
+		{`"a" IN [doc][nested]`, false, "arrays must hold only strings or only numbers, got []interface {}"},
+	}
+	for _, td := range data {
+		expr, err := NewParser(strings.NewReader(td.cond)).Parse()
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+		prg, err := Compile(expr)
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+		r, err := Evaluate(expr, args)
+		pr, perr := prg.Evaluate(args)
+		if td.err != "" {
+			if assert.NotNil(t, err, td.cond) && assert.NotNil(t, perr, td.cond) {
+				assert.Contains(t, err.Error(), td.err, td.cond)
+				assert.Contains(t, perr.Error(), td.err, td.cond)
+			}
+			continue
+		}
+		assert.Nil(t, err, td.cond)
+		assert.Nil(t, perr, td.cond)
+		assert.Equal(t, td.result, r, td.cond)
+		assert.Equal(t, td.result, pr, td.cond)
+	}
+}
+
+func TestNestedLookupDoesNotAllocate(t *testing.T) {
+	expr, err := NewParser(strings.NewReader(`[user][roles][0][level] > 2`)).Parse()
+	assert.Nil(t, err)
+	prg, err := Compile(expr)
+	assert.Nil(t, err)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := prg.Evaluate(nestedArgs); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.Equal(t, 0.0, allocs)
+}
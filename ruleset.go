@@ -0,0 +1,263 @@
+package conditions
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Rule is a named condition of a RuleSet.
+type Rule struct {
+	Name string
+	Expr Expr
+	// Priority orders the evaluation, rules of higher priority first
+	Priority int
+	// Metadata is attached by the application and left untouched
+	Metadata map[string]interface{}
+
+	prg  *Program
+	seq  int
+	keys []indexKey
+}
+
+// before reports whether r is evaluated before o.
+func (r *Rule) before(o *Rule) bool {
+	return r.Priority > o.Priority || r.Priority == o.Priority && r.seq < o.seq
+}
+
+// MatchStrategy is the maximum number of rules RuleSet.Match returns,
+// evaluation stops once reached.
+type MatchStrategy int
+
+const (
+	// MatchAll evaluates every rule.
+	MatchAll MatchStrategy = 0
+	// MatchFirst stops at the first matching rule by priority.
+	MatchFirst MatchStrategy = 1
+)
+
+// MatchN stops after n matching rules.
+func MatchN(n int) MatchStrategy {
+	if n < 1 {
+		return MatchAll
+	}
+	return MatchStrategy(n)
+}
+
+// RuleError reports a rule which failed to evaluate.
+type RuleError struct {
+	Rule string
+	Err  error
+}
+
+// Error returns the string representation of the error.
+func (e *RuleError) Error() string { return fmt.Sprintf("Rule %s: %s", e.Rule, e.Err) }
+
+// RuleErrors is the list of the rules which failed to evaluate.
+type RuleErrors []*RuleError
+
+// Error returns the string representation of the errors.
+func (e RuleErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// RuleSet holds named compiled conditions evaluated together against the
+// same args. A RuleSet is safe for concurrent use.
+type RuleSet struct {
+	opts Options
+
+	mu    sync.RWMutex
+	rules []*Rule // by priority
+	names map[string]*Rule
+	vars  map[string]*ruleVar
+	index *ruleIndex
+	seq   int
+}
+
+// ruleVar is a variable referenced by the rules.
+type ruleVar struct {
+	ref  *VarRef
+	refs int
+}
+
+// NewRuleSet returns an empty RuleSet evaluating its rules with the given
+// options. The rules are compiled, Add fails when opts.MaxSteps is set.
+func NewRuleSet(opts Options) *RuleSet {
+	return &RuleSet{
+		opts:  opts,
+		names: make(map[string]*Rule),
+		vars:  make(map[string]*ruleVar),
+	}
+}
+
+// NewIndexedRuleSet returns an empty RuleSet which indexes the equality,
+// IN and numeric range comparisons of its rules. Match then evaluates only
+// the rules which may match, giving the same matches as NewRuleSet. Rules
+// ruled out by the index are not evaluated, so their evaluation errors are
+// not reported.
+func NewIndexedRuleSet(opts Options) *RuleSet {
+	s := NewRuleSet(opts)
+	s.index = newRuleIndex(opts.Missing)
+	return s
+}
+
+// Add compiles the rule expression and adds the rule to the set. Rule
+// names are unique.
+func (s *RuleSet) Add(rule Rule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("Rule name is empty")
+	}
+	// Variables are resolved once by Match, the program looks up the
+	// resolved values by name.
+	opts := s.opts
+	opts.Lookup = LookupFlat
+	prg, err := CompileWithOptions(rule.Expr, opts)
+	if err != nil {
+		return &RuleError{Rule: rule.Name, Err: err}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.names[rule.Name]; ok {
+		return fmt.Errorf("Rule %s already exists", rule.Name)
+	}
+	r := &rule
+	r.prg, r.seq = prg, s.seq
+	s.seq++
+
+	// Rules of the same priority keep the order they were added in.
+	i := sort.Search(len(s.rules), func(i int) bool { return s.rules[i].Priority < r.Priority })
+	s.rules = append(s.rules, nil)
+	copy(s.rules[i+1:], s.rules[i:])
+	s.rules[i] = r
+	s.names[r.Name] = r
+	if s.index != nil {
+		s.index.add(r)
+	}
+
+	for _, ref := range varRefs(r.Expr, nil) {
+		v, ok := s.vars[ref.Val]
+		if !ok {
+			v = &ruleVar{ref: ref}
+			s.vars[ref.Val] = v
+		}
+		v.refs++
+	}
+	return nil
+}
+
+// Remove removes the named rule and reports whether it was in the set.
+func (s *RuleSet) Remove(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.names[name]
+	if !ok {
+		return false
+	}
+	delete(s.names, name)
+	s.rules = removeRule(s.rules, r)
+	if s.index != nil {
+		s.index.remove(r)
+	}
+	for _, ref := range varRefs(r.Expr, nil) {
+		v := s.vars[ref.Val]
+		if v.refs--; v.refs == 0 {
+			delete(s.vars, ref.Val)
+		}
+	}
+	return true
+}
+
+// Rule returns the named rule.
+func (s *RuleSet) Rule(name string) (Rule, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.names[name]
+	if !ok {
+		return Rule{}, false
+	}
+	return *r, true
+}
+
+// Len returns the number of rules in the set.
+func (s *RuleSet) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.rules)
+}
+
+// Match evaluates the rules by priority, rules of the same priority in
+// the order they were added, and returns the names of the matching ones.
+// Every variable is resolved once for all the rules. A rule which fails to
+// evaluate does not match, the failures are returned as RuleErrors along
+// with the matches.
+func (s *RuleSet) Match(args map[string]interface{}, strategy MatchStrategy) ([]string, error) {
+	s.mu.RLock()
+	for s.index != nil && s.index.dirty() {
+		s.mu.RUnlock()
+		s.mu.Lock()
+		s.index.build()
+		s.mu.Unlock()
+		s.mu.RLock()
+	}
+	defer s.mu.RUnlock()
+
+	resolved := make(map[string]interface{}, len(s.vars))
+	for name, v := range s.vars {
+		if arg, ok := lookup(args, v.ref, s.opts.Lookup); ok {
+			resolved[name] = arg
+		}
+	}
+
+	rules := s.rules
+	if s.index != nil {
+		rules = s.index.candidates(resolved)
+	}
+
+	var (
+		matches []string
+		errs    RuleErrors
+	)
+	for _, r := range rules {
+		ok, err := r.prg.Evaluate(resolved)
+		if err != nil {
+			errs = append(errs, &RuleError{Rule: r.Name, Err: err})
+			continue
+		}
+		if !ok {
+			continue
+		}
+		matches = append(matches, r.Name)
+		if strategy > 0 && len(matches) == int(strategy) {
+			break
+		}
+	}
+	if len(errs) > 0 {
+		return matches, errs
+	}
+	return matches, nil
+}
+
+// varRefs appends the variable references of expr to refs.
+func varRefs(expr Expr, refs []*VarRef) []*VarRef {
+	switch n := expr.(type) {
+	case *VarRef:
+		refs = append(refs, n)
+	case *ParenExpr:
+		refs = varRefs(n.Expr, refs)
+	case *UnaryExpr:
+		refs = varRefs(n.Expr, refs)
+	case *BinaryExpr:
+		refs = varRefs(n.RHS, varRefs(n.LHS, refs))
+	case *CallExpr:
+		for _, arg := range n.Arguments {
+			refs = varRefs(arg, refs)
+		}
+	}
+	return refs
+}
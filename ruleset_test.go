@@ -0,0 +1,105 @@
+package conditions
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRuleSet(t *testing.T, opts Options) *RuleSet {
+	rules := []struct {
+		name     string
+		cond     string
+		priority int
+	}{
+		{"adult", `[user][age] >= 18`, 0},
+		{"admin", `[user][role] == "admin"`, 10},
+		{"senior", `[user][age] >= 65`, 0},
+		{"moderator", `[user][role] in ["admin", "moderator"]`, 5},
+		{"scored", `[score] > 0.5`, 5},
+	}
+	s := NewRuleSet(opts)
+	for _, r := range rules {
+		expr, err := NewParser(strings.NewReader(r.cond)).Parse()
+		assert.Nil(t, err, r.cond)
+		assert.Nil(t, s.Add(Rule{Name: r.name, Expr: expr, Priority: r.priority, Metadata: map[string]interface{}{"cond": r.cond}}))
+	}
+	return s
+}
+
+func TestRuleSetMatch(t *testing.T) {
+	s := newTestRuleSet(t, Options{})
+	args := map[string]interface{}{
+		"user":  map[string]interface{}{"age": 70, "role": "admin"},
+		"score": 0.9,
+	}
+	data := []struct {
+		strategy MatchStrategy
+		want     []string
+	}{
+		{MatchAll, []string{"admin", "moderator", "scored", "adult", "senior"}},
+		{MatchFirst, []string{"admin"}},
+		{MatchN(2), []string{"admin", "moderator"}},
+		{MatchN(10), []string{"admin", "moderator", "scored", "adult", "senior"}},
+		{MatchN(0), []string{"admin", "moderator", "scored", "adult", "senior"}},
+	}
+	for _, td := range data {
+		matches, err := s.Match(args, td.strategy)
+		assert.Nil(t, err)
+		assert.Equal(t, td.want, matches, "strategy %d", td.strategy)
+	}
+
+	matches, err := s.Match(map[string]interface{}{"user": map[string]interface{}{"age": 20, "role": "guest"}, "score": 0.1}, MatchAll)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"adult"}, matches)
+}
+
+func TestRuleSetErrors(t *testing.T) {
+	s := newTestRuleSet(t, Options{})
+
+	// Failing rules do not stop the evaluation of the others.
+	matches, err := s.Match(map[string]interface{}{"user": map[string]interface{}{"age": 30, "role": 1}}, MatchAll)
+	assert.Equal(t, []string{"adult"}, matches)
+	if errs, ok := err.(RuleErrors); assert.True(t, ok) {
+		var names []string
+		for _, e := range errs {
+			names = append(names, e.Rule)
+		}
+		assert.Equal(t, []string{"admin", "moderator", "scored"}, names)
+		assert.Contains(t, errs[2].Error(), "Rule scored: argument: score not found")
+	}
+
+	expr, _ := NewParser(strings.NewReader(`[a]`)).Parse()
+	assert.NotNil(t, s.Add(Rule{Name: "adult", Expr: expr}))
+	assert.NotNil(t, s.Add(Rule{Expr: expr}))
+	err = s.Add(Rule{Name: "bad", Expr: &BadExpr{}})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "bad", err.(*RuleError).Rule)
+	}
+	assert.Equal(t, 5, s.Len())
+}
+
+func TestRuleSetRemove(t *testing.T) {
+	s := newTestRuleSet(t, Options{Lookup: LookupFlat})
+
+	r, ok := s.Rule("senior")
+	assert.True(t, ok)
+	assert.Equal(t, "senior", r.Name)
+	assert.Equal(t, `[user][age] >= 65`, r.Metadata["cond"])
+
+	assert.True(t, s.Remove("senior"))
+	assert.True(t, s.Remove("scored"))
+	assert.False(t, s.Remove("scored"))
+	_, ok = s.Rule("senior")
+	assert.False(t, ok)
+	assert.Equal(t, 3, s.Len())
+
+	// Rules added later keep the priority order, the removed rules no
+	// longer need their variables.
+	expr, _ := NewParser(strings.NewReader(`[user.age] < 100`)).Parse()
+	assert.Nil(t, s.Add(Rule{Name: "alive", Expr: expr, Priority: 5}))
+	matches, err := s.Match(map[string]interface{}{"user.age": 70, "user.role": "moderator"}, MatchAll)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"moderator", "alive", "adult"}, matches)
+}
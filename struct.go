@@ -0,0 +1,141 @@
+package conditions
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EvaluateStruct takes an expr and evaluates it resolving variables
+// against the fields of a struct (or a pointer to one). [Field][SubField]
+// walks nested structs, maps with string keys, slices and arrays. Fields
+// are matched by the name in their `cond:"name"` tag, or by their Go name
+// when untagged; unexported fields and fields tagged `cond:"-"` are not
+// visible.
+func EvaluateStruct(expr Expr, v interface{}) (bool, error) {
+	return evaluate(expr, &structResolver{root: reflect.ValueOf(v)})
+}
+
+// structResolver resolves variable references against struct fields.
+type structResolver struct {
+	root reflect.Value
+}
+
+func (r *structResolver) resolve(ref *VarRef) (interface{}, bool) {
+	path := ref.Path
+	if len(path) == 0 {
+		path = []string{ref.Val}
+	}
+
+	cur := r.root
+	for _, seg := range path {
+		cur = indirect(cur)
+		switch cur.Kind() {
+		case reflect.Struct:
+			index, ok := structFields(cur.Type())[seg]
+			if !ok {
+				return nil, false
+			}
+			// Promoted fields of a nil embedded pointer are not set.
+			var err error
+			if cur, err = cur.FieldByIndexErr(index); err != nil {
+				return nil, false
+			}
+		case reflect.Map:
+			if cur.Type().Key().Kind() != reflect.String {
+				return nil, false
+			}
+			cur = cur.MapIndex(reflect.ValueOf(seg).Convert(cur.Type().Key()))
+		case reflect.Slice, reflect.Array:
+			i, ok := parseIndex(seg)
+			if !ok || i >= cur.Len() {
+				return nil, false
+			}
+			cur = cur.Index(i)
+		default:
+			return nil, false
+		}
+		if !cur.IsValid() {
+			return nil, false
+		}
+	}
+
+	cur = indirect(cur)
+	if !cur.IsValid() {
+		return nil, false
+	}
+	return basicValue(cur), true
+}
+
+func (r *structResolver) missingMode() MissingMode { return MissingError }
+
+// indirect dereferences pointers and interfaces, nil ones give an invalid
+// value
+func indirect(v reflect.Value) reflect.Value {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+// basicValue converts values of named basic types, e.g. type Status string,
+// to the types the evaluator works with
+func basicValue(v reflect.Value) interface{} {
+	// Durations are int64 and times structs, they keep their type.
+	switch v.Type() {
+	case durationType:
+		return time.Duration(v.Int())
+	case timeType:
+		return v.Interface()
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return v.Bool()
+	}
+	return v.Interface()
+}
+
+// fieldCache maps struct types to the index of their visible fields by name.
+var fieldCache sync.Map // map[reflect.Type]map[string][]int
+
+// structFields returns the visible fields of a struct type by name
+func structFields(t reflect.Type) map[string][]int {
+	if fields, ok := fieldCache.Load(t); ok {
+		return fields.(map[string][]int)
+	}
+
+	fields := map[string][]int{}
+	for _, f := range reflect.VisibleFields(t) {
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("cond"); ok {
+			if tag = strings.Split(tag, ",")[0]; tag == "-" {
+				continue
+			} else if tag != "" {
+				name = tag
+			}
+		}
+		// Fields of the outer struct win over promoted ones.
+		if prev, ok := fields[name]; ok && len(prev) <= len(f.Index) {
+			continue
+		}
+		fields[name] = f.Index
+	}
+
+	actual, _ := fieldCache.LoadOrStore(t, fields)
+	return actual.(map[string][]int)
+}
@@ -0,0 +1,98 @@
+package conditions
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testStatus string
+
+type testAddress struct {
+	City    string `cond:"city"`
+	Country string
+}
+
+type testBase struct {
+	ID int
+}
+
+type testUser struct {
+	*testBase
+	Name     string `cond:"name"`
+	Age      int
+	Score    float32
+	Active   bool
+	Status   testStatus
+	Tags     []string
+	Address  *testAddress `cond:"address"`
+	Previous []testAddress
+	Labels   map[string]string
+	Timeout  time.Duration
+	Created  time.Time
+	Secret   string `cond:"-"`
+	password string
+}
+
+func TestEvaluateStruct(t *testing.T) {
+	user := &testUser{
+		testBase: &testBase{ID: 7},
+		Name:     "admin",
+		Age:      42,
+		Score:    0.5,
+		Active:   true,
+		Status:   "ON",
+		Tags:     []string{"a", "b"},
+		Address:  &testAddress{City: "Kyiv", Country: "UA"},
+		Previous: []testAddress{{City: "Lviv"}},
+		Labels:   map[string]string{"team": "core"},
+		Timeout:  10 * time.Second,
+		Created:  time.Date(2017, 9, 13, 0, 0, 0, 0, time.UTC),
+		Secret:   "s",
+		password: "p",
+	}
+
+	data := []struct {
+		cond   string
+		result bool
+		isErr  bool
+	}{
+		{`[name] == "admin" AND [Age] > 40`, true, false},
+		{`[Score] < 1 AND [Active]`, true, false},
+		{`[Status] == "ON"`, true, false},
+		{`"b" in [Tags]`, true, false},
+		{`[address][city] == "Kyiv"`, true, false},
+		{`[address][Country] == "UA"`, true, false},
+		{`[Previous][0][city] == "Lviv"`, true, false},
+		{`[Labels][team] == "core"`, true, false},
+		{`[ID] == 7`, true, false},
+		{`[Timeout] > 5s AND [Timeout] * 2 == 20s`, true, false},
+		{`[Created] < TIME "2018-01-01" AND [Created] + 24h > TIME "2017-09-13T12:00:00Z"`, true, false},
+		{`[Name] == "admin"`, false, true},
+		{`[address][City] == "Kyiv"`, false, true},
+		{`[Secret] == "s"`, false, true},
+		{`[password] == "p"`, false, true},
+		{`[Previous][1][city] == "Lviv"`, false, true},
+		{`[unknown] == 1`, false, true},
+	}
+
+	for _, td := range data {
+		expr, err := NewParser(strings.NewReader(td.cond)).Parse()
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+		r, err := EvaluateStruct(expr, user)
+		assert.Equal(t, td.isErr, err != nil, td.cond)
+		assert.Equal(t, td.result, r, td.cond)
+		if td.isErr && err != nil {
+			assert.Contains(t, err.Error(), "not found", td.cond)
+		}
+	}
+
+	// Non-pointer values and nil embedded pointers
+	expr, _ := NewParser(strings.NewReader(`[ID] == 7`)).Parse()
+	_, err := EvaluateStruct(expr, testUser{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,194 @@
+package conditions
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// durationUnits maps duration unit suffixes to their length.
+var durationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"u":  time.Microsecond,
+	"µ":  time.Microsecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+}
+
+// timeLayouts are the accepted layouts of timestamp literals.
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+}
+
+// ParseDuration parses a duration literal made of one or more numbers with
+// a unit, e.g. 5m, 1h30m or 250ms, and an optional leading minus sign. It
+// accepts the output of FormatDuration.
+func ParseDuration(s string) (time.Duration, error) {
+	digits := strings.TrimPrefix(s, "-")
+	if digits == "" {
+		return 0, fmt.Errorf("Invalid duration: %q", s)
+	}
+
+	var d time.Duration
+	for rest := digits; rest != ""; {
+		i := strings.IndexFunc(rest, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+		if i <= 0 {
+			return 0, fmt.Errorf("Invalid duration: %q", s)
+		}
+		n, err := strconv.ParseFloat(rest[:i], 64)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid duration: %q", s)
+		}
+		rest = rest[i:]
+
+		j := strings.IndexFunc(rest, func(r rune) bool { return (r >= '0' && r <= '9') || r == '.' })
+		if j < 0 {
+			j = len(rest)
+		}
+		unit, ok := durationUnits[rest[:j]]
+		if !ok {
+			return 0, fmt.Errorf("Invalid duration: %q", s)
+		}
+		rest = rest[j:]
+
+		// Every part is positive, the sum overflows past math.MaxInt64.
+		v := n * float64(unit)
+		if v >= math.MaxInt64 || time.Duration(v) > math.MaxInt64-d {
+			return 0, fmt.Errorf("Duration out of range: %q", s)
+		}
+		d += time.Duration(v)
+	}
+	if len(digits) < len(s) {
+		d = -d
+	}
+	return d, nil
+}
+
+// ParseTime parses a timestamp literal, either RFC 3339 or
+// "2006-01-02 15:04:05.999" and "2006-01-02" in UTC.
+func ParseTime(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid time: %q", s)
+}
+
+// unordered is the result of compareValues when an operand is NaN, no
+// ordered comparison holds for it.
+const unordered = 2
+
+// compareValues orders two numbers, times or durations, see unordered
+func compareValues(l, r value) (int, error) {
+	switch l.kind {
+	case kindTime:
+		if r.kind != kindTime {
+			return 0, fmt.Errorf("Literal is not a time: %s", r)
+		}
+		switch {
+		case l.t.Before(r.t):
+			return -1, nil
+		case l.t.After(r.t):
+			return 1, nil
+		}
+		return 0, nil
+	case kindDuration:
+		if r.kind != kindDuration {
+			return 0, fmt.Errorf("Literal is not a duration: %s", r)
+		}
+		return compareFloats(float64(l.d), float64(r.d)), nil
+	case kindNumber:
+		if r.kind != kindNumber {
+			return 0, fmt.Errorf("Literal is not a number: %s", r)
+		}
+		return compareFloats(l.n, r.n), nil
+	}
+	return 0, fmt.Errorf("Literal is not a number: %s", l)
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	case a == b:
+		return 0
+	}
+	return unordered
+}
+
+// timeArithmetic applies an arithmetic operator to operands of which at
+// least one is a time or a duration:
+//
+//	time - time         = duration
+//	time ± duration     = time
+//	duration + time     = time
+//	duration ± duration = duration
+//	duration * number   = duration
+//	number * duration   = duration
+//	duration / number   = duration
+//	duration / duration = number
+func timeArithmetic(op Token, l, r value) (value, error) {
+	switch {
+	case l.kind == kindTime && r.kind == kindTime && op == SUB:
+		return value{kind: kindDuration, d: l.t.Sub(r.t)}, nil
+	case l.kind == kindTime && r.kind == kindDuration && op == ADD:
+		return value{kind: kindTime, t: l.t.Add(r.d)}, nil
+	case l.kind == kindTime && r.kind == kindDuration && op == SUB:
+		return value{kind: kindTime, t: l.t.Add(-r.d)}, nil
+	case l.kind == kindDuration && r.kind == kindTime && op == ADD:
+		return value{kind: kindTime, t: r.t.Add(l.d)}, nil
+	case l.kind == kindDuration && r.kind == kindDuration && op == ADD:
+		return value{kind: kindDuration, d: l.d + r.d}, nil
+	case l.kind == kindDuration && r.kind == kindDuration && op == SUB:
+		return value{kind: kindDuration, d: l.d - r.d}, nil
+	case l.kind == kindDuration && r.kind == kindNumber && op == MUL:
+		return value{kind: kindDuration, d: time.Duration(float64(l.d) * r.n)}, nil
+	case l.kind == kindNumber && r.kind == kindDuration && op == MUL:
+		return value{kind: kindDuration, d: time.Duration(l.n * float64(r.d))}, nil
+	case l.kind == kindDuration && r.kind == kindNumber && op == DIV:
+		if r.n == 0 {
+			return value{}, fmt.Errorf("Division by zero")
+		}
+		return value{kind: kindDuration, d: time.Duration(float64(l.d) / r.n)}, nil
+	case l.kind == kindDuration && r.kind == kindDuration && op == DIV:
+		if r.d == 0 {
+			return value{}, fmt.Errorf("Division by zero")
+		}
+		return value{kind: kindNumber, n: float64(l.d) / float64(r.d)}, nil
+	}
+	return value{}, fmt.Errorf("Cannot apply %s to %s and %s", op, l, r)
+}
+
+// arithmeticType returns the type of an arithmetic operation on operands
+// of the given types, Unknown when it is not defined.
+func arithmeticType(op Token, l, r DataType) DataType {
+	switch {
+	case l == Number && r == Number:
+		return Number
+	case l == Time && r == Time && op == SUB:
+		return Duration
+	case l == Time && r == Duration && (op == ADD || op == SUB),
+		l == Duration && r == Time && op == ADD:
+		return Time
+	case l == Duration && r == Duration && (op == ADD || op == SUB),
+		l == Duration && r == Number && (op == MUL || op == DIV),
+		l == Number && r == Duration && op == MUL:
+		return Duration
+	case l == Duration && r == Duration && op == DIV:
+		return Number
+	}
+	return Unknown
+}
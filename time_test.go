@@ -0,0 +1,123 @@
+package conditions
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDuration(t *testing.T) {
+	valid := map[string]time.Duration{
+		"5m":      5 * time.Minute,
+		"1h30m":   90 * time.Minute,
+		"250ms":   250 * time.Millisecond,
+		"1.5h":    90 * time.Minute,
+		"2d":      48 * time.Hour,
+		"1w":      7 * 24 * time.Hour,
+		"10u":     10 * time.Microsecond,
+		"7ns":     7,
+		"1h0m30s": time.Hour + 30*time.Second,
+		"-5m":     -5 * time.Minute,
+	}
+	for s, want := range valid {
+		d, err := ParseDuration(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, want, d, s)
+	}
+
+	for _, s := range []string{"", "-", "--5m", "5", "m", "5x", "1h30", "5mm", "99999999999w", "16000w", "10000w6000w", "-16000w"} {
+		_, err := ParseDuration(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestFormatDurationRoundTrip(t *testing.T) {
+	for _, d := range []time.Duration{
+		2 * 7 * 24 * time.Hour,
+		3 * 24 * time.Hour,
+		90 * time.Minute,
+		61 * time.Second,
+		1500 * time.Millisecond,
+		1500 * time.Microsecond,
+		1500,
+	} {
+		parsed, err := ParseDuration(FormatDuration(d))
+		assert.Nil(t, err, FormatDuration(d))
+		assert.Equal(t, d, parsed, FormatDuration(d))
+
+		expr, err := NewParser(strings.NewReader(FormatDuration(d))).Parse()
+		assert.Nil(t, err, FormatDuration(d))
+		assert.Equal(t, &DurationLiteral{Val: d}, expr)
+	}
+}
+
+func TestTimeConditions(t *testing.T) {
+	now := time.Date(2017, 9, 13, 12, 0, 0, 0, time.UTC)
+	args := map[string]interface{}{
+		"now":       now,
+		"last_seen": now.Add(-15 * time.Minute),
+		"created":   now.Add(-48 * time.Hour),
+		"timeout":   30 * time.Second,
+		"count":     3,
+	}
+
+	data := []struct {
+		cond   string
+		result bool
+		isErr  bool
+	}{
+		{"[now] - [last_seen] > 10m", true, false},
+		{"[now] - [last_seen] > 1h30m", false, false},
+		{"[now] - [last_seen] == 15m", true, false},
+		{"[timeout] <= 30s AND [timeout] != 1m", true, false},
+		{"[timeout] * [count] == 90s", true, false},
+		{"[timeout] / 2 == 15s", true, false},
+		{"1m / [timeout] == 2", true, false},
+		{"[last_seen] + 15m == [now]", true, false},
+		{"10m + [last_seen] < [now]", true, false},
+		{"[created] < [now] - 1d", true, false},
+		{"[timeout] > -5s", true, false},
+		{`[now] > TIME "2017-09-13T00:00:00Z"`, true, false},
+		{`[now] == TIME "2017-09-13 12:00:00"`, true, false},
+		{`[created] >= TIME "2017-09-11"`, true, false},
+		{`[now] == TIME "2017-09-13T14:00:00+02:00"`, true, false},
+		{"[timeout] > 10", false, true},
+		{"[now] > 10m", false, true},
+		{"[now] + [now] > 10m", false, true},
+		{"[timeout] == 30", false, true},
+	}
+
+	for _, td := range data {
+		expr, err := NewParser(strings.NewReader(td.cond)).Parse()
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+
+		r, err := Evaluate(expr, args)
+		assert.Equal(t, td.isErr, err != nil, td.cond)
+		assert.Equal(t, td.result, r, td.cond)
+
+		prg, err := Compile(expr)
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+		r, err = prg.Evaluate(args)
+		assert.Equal(t, td.isErr, err != nil, td.cond)
+		assert.Equal(t, td.result, r, td.cond)
+	}
+}
+
+func TestInvalidTimeLiterals(t *testing.T) {
+	for _, cond := range []string{
+		`[now] > TIME "yesterday"`,
+		`[now] > TIME`,
+		`[d] > 5 m`,
+		`[d] > 99999999999w`,
+	} {
+		expr, err := NewParser(strings.NewReader(cond)).Parse()
+		assert.NotNil(t, err, cond)
+		assert.Nil(t, expr, cond)
+	}
+}
@@ -1,5 +1,12 @@
 package conditions
 
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
 // Token represents a lexical token.
 type Token int
 
@@ -11,12 +18,14 @@ const (
 
 	// Literals
 	literalBegin
-	IDENT  // Variable references $0, $5, etc
-	NUMBER // 12345.67
-	STRING // "abc"
-	ARRAY  // array of values (string or number) ["a","b","c"]  [342,4325,6,4]
-	TRUE   // true
-	FALSE  // false
+	IDENT    // Variable references $0, $5, etc
+	NUMBER   // 12345.67
+	STRING   // "abc"
+	ARRAY    // array of values (string or number) ["a","b","c"]  [342,4325,6,4]
+	TRUE     // true
+	FALSE    // false
+	DURATION // 1h30m
+	TIME     // TIME "2006-01-02T15:04:05Z"
 	literalEnd
 
 	operatorBegin
@@ -34,22 +43,36 @@ const (
 	NEREG // !~
 	IN    // IN
 	NOTIN // NOT IN
+	ADD   // +
+	SUB   // -
+	MUL   // *
+	DIV   // /
+	MOD   // %
 	operatorEnd
 
+	NOT       // NOT, !
+	EXISTS    // EXISTS
+	ISNULL    // IS NULL
+	ISNOTNULL // IS NOT NULL
+	FUNC      // function name, e.g. lower
+
 	LPAREN // (
 	RPAREN // )
+	COMMA  // ,
 )
 
 var tokens = [...]string{
 	ILLEGAL: "ILLEGAL",
 	EOF:     "EOF",
 
-	IDENT:  "IDENT",
-	NUMBER: "NUMBER",
-	STRING: "STRING",
-	ARRAY:  "ARRAY",
-	TRUE:   "TRUE",
-	FALSE:  "FALSE",
+	IDENT:    "IDENT",
+	NUMBER:   "NUMBER",
+	STRING:   "STRING",
+	ARRAY:    "ARRAY",
+	TRUE:     "TRUE",
+	FALSE:    "FALSE",
+	DURATION: "DURATION",
+	TIME:     "TIME",
 
 	AND: "AND",
 	OR:  "OR",
@@ -66,9 +89,21 @@ var tokens = [...]string{
 	NEREG: "!~",
 	IN:    "IN",
 	NOTIN: "NOT IN",
+	ADD:   "+",
+	SUB:   "-",
+	MUL:   "*",
+	DIV:   "/",
+	MOD:   "%",
+
+	NOT:       "NOT",
+	EXISTS:    "EXISTS",
+	ISNULL:    "IS NULL",
+	ISNOTNULL: "IS NOT NULL",
+	FUNC:      "FUNC",
 
 	LPAREN: "(",
 	RPAREN: ")",
+	COMMA:  ",",
 }
 
 // String returns the string representation of the token.
@@ -89,6 +124,10 @@ func (tok Token) Precedence() int {
 
 	case EQ, NEQ, LT, LTE, GT, GTE, IN, NOTIN, EREG, NEREG:
 		return 3
+	case ADD, SUB:
+		return 4
+	case MUL, DIV, MOD:
+		return 5
 	}
 	return 0
 }
@@ -103,3 +142,415 @@ func tokstr(tok Token, lit string) string {
 	}
 	return tok.String()
 }
+
+// eof is returned by the lexer at the end of the source.
+const eof = rune(-1)
+
+// Lexer splits the source of a condition into tokens.
+type Lexer struct {
+	src string
+	// position of the next character
+	pos Pos
+	// Error is called for malformed tokens, such as unterminated strings,
+	// which are returned as ILLEGAL.
+	Error func(pos Pos, msg string)
+}
+
+// NewLexer returns a new instance of Lexer reading src.
+func NewLexer(src string) *Lexer {
+	return &Lexer{src: src, pos: Pos{Line: 1, Column: 1}}
+}
+
+// Scan returns the next token, its literal and its position. The literal
+// of a string is its unquoted value, the literal of a variable reference
+// is its flat name, "a.b" for [a][b], and the literal of an array is the
+// source between its brackets.
+func (l *Lexer) Scan() (tok Token, lit string, pos Pos) {
+	l.skipWhitespace()
+	pos = l.pos
+
+	switch ch := l.peek(); {
+	case ch == eof:
+		return EOF, "", pos
+	case isLetter(ch):
+		return l.scanWord(pos)
+	case isDigit(ch), ch == '.' && isDigit(l.peekAt(1)):
+		return l.scanNumber(pos)
+	case ch == '"', ch == '\'', ch == '`':
+		return l.scanString(pos)
+	case ch == '[':
+		return l.scanBracket(pos)
+	case ch == '$':
+		return l.scanDollar(pos)
+	}
+
+	ch := l.read()
+	switch ch {
+	case '(':
+		return LPAREN, "(", pos
+	case ')':
+		return RPAREN, ")", pos
+	case ',':
+		return COMMA, ",", pos
+	case '+':
+		return ADD, "+", pos
+	case '-':
+		return SUB, "-", pos
+	case '*':
+		return MUL, "*", pos
+	case '/':
+		// A slash is a division operator unless the parser expects an
+		// operand, see ScanRegex.
+		return DIV, "/", pos
+	case '%':
+		return MOD, "%", pos
+	case '=':
+		if l.accept('=') {
+			return EQ, "==", pos
+		} else if l.accept('~') {
+			return EREG, "=~", pos
+		}
+	case '!':
+		if l.accept('=') {
+			return NEQ, "!=", pos
+		} else if l.accept('~') {
+			return NEREG, "!~", pos
+		}
+		return NOT, "!", pos
+	case '>':
+		if l.accept('=') {
+			return GTE, ">=", pos
+		}
+		return GT, ">", pos
+	case '<':
+		if l.accept('=') {
+			return LTE, "<=", pos
+		}
+		return LT, "<", pos
+	}
+	return ILLEGAL, l.src[pos.Offset:l.pos.Offset], pos
+}
+
+// ScanRegex reads a regular expression literal whose opening slash has
+// just been returned as DIV, up to the closing slash and the flags
+// following it. A slash is escaped with a backslash, other escapes are
+// kept as they are.
+func (l *Lexer) ScanRegex() (pattern, flags string, err error) {
+	var b strings.Builder
+	for closed := false; !closed; {
+		switch ch := l.read(); ch {
+		case eof, '\n':
+			return "", "", fmt.Errorf("Unterminated regular expression")
+		case '/':
+			closed = true
+		case '\\':
+			next := l.read()
+			if next == eof || next == '\n' {
+				return "", "", fmt.Errorf("Unterminated regular expression")
+			}
+			if next != '/' {
+				b.WriteRune(ch)
+			}
+			b.WriteRune(next)
+		default:
+			b.WriteRune(ch)
+		}
+	}
+
+	for isLetter(l.peek()) {
+		ch := l.read()
+		if !strings.ContainsRune(regexFlags, ch) {
+			return "", "", fmt.Errorf("Unknown regular expression flag %c", ch)
+		}
+		if strings.ContainsRune(flags, ch) {
+			return "", "", fmt.Errorf("Duplicate regular expression flag %c", ch)
+		}
+		flags += string(ch)
+	}
+	return b.String(), flags, nil
+}
+
+// scanWord reads a keyword, a function name or a bare variable name.
+func (l *Lexer) scanWord(pos Pos) (Token, string, Pos) {
+	word := l.scanIdent()
+	switch strings.ToUpper(word) {
+	case "AND":
+		return AND, word, pos
+	case "OR":
+		return OR, word, pos
+	case "XOR":
+		return XOR, word, pos
+	case "NAND":
+		return NAND, word, pos
+	case "IN":
+		return IN, word, pos
+	case "NOT":
+		save := l.pos
+		l.skipWhitespace()
+		if strings.ToUpper(l.scanIdent()) == "IN" {
+			return NOTIN, "NOT IN", pos
+		}
+		l.pos = save
+		return NOT, word, pos
+	case "EXISTS":
+		return EXISTS, word, pos
+	case "IS":
+		// IS is a bare variable name unless followed by [NOT] NULL.
+		save := l.pos
+		l.skipWhitespace()
+		next := strings.ToUpper(l.scanIdent())
+		if next == "NULL" {
+			return ISNULL, "IS NULL", pos
+		}
+		if next == "NOT" {
+			l.skipWhitespace()
+			if strings.ToUpper(l.scanIdent()) == "NULL" {
+				return ISNOTNULL, "IS NOT NULL", pos
+			}
+		}
+		l.pos = save
+	case "TRUE":
+		return TRUE, word, pos
+	case "FALSE":
+		return FALSE, word, pos
+	case "TIME":
+		return TIME, word, pos
+	}
+
+	// An identifier followed by ( is a function name.
+	save := l.pos
+	l.skipWhitespace()
+	next := l.peek()
+	l.pos = save
+	if next == '(' {
+		return FUNC, word, pos
+	}
+	return IDENT, word, pos
+}
+
+// scanIdent reads letters, digits and underscores.
+func (l *Lexer) scanIdent() string {
+	start := l.pos.Offset
+	for ch := l.peek(); isLetter(ch) || isDigit(ch); ch = l.peek() {
+		l.read()
+	}
+	return l.src[start:l.pos.Offset]
+}
+
+// scanNumber reads a number with an optional fraction and exponent, or
+// a duration when a unit immediately follows it, e.g. 1h30m.
+func (l *Lexer) scanNumber(pos Pos) (Token, string, Pos) {
+	l.scanDigits()
+	if l.peek() == '.' {
+		l.read()
+		l.scanDigits()
+	}
+	if ch := l.peek(); ch == 'e' || ch == 'E' {
+		save := l.pos
+		l.read()
+		if ch := l.peek(); ch == '+' || ch == '-' {
+			l.read()
+		}
+		if isDigit(l.peek()) {
+			l.scanDigits()
+		} else {
+			l.pos = save
+		}
+	}
+	lit := l.src[pos.Offset:l.pos.Offset]
+
+	if isLetter(l.peek()) {
+		save := l.pos
+		for ch := l.peek(); isLetter(ch) || isDigit(ch) || ch == '.'; ch = l.peek() {
+			l.read()
+		}
+		d := l.src[pos.Offset:l.pos.Offset]
+		if _, err := ParseDuration(d); err == nil {
+			return DURATION, d, pos
+		}
+		l.pos = save
+	}
+	return NUMBER, lit, pos
+}
+
+func (l *Lexer) scanDigits() {
+	for isDigit(l.peek()) {
+		l.read()
+	}
+}
+
+// scanString reads a string quoted with ", ' or `. Backslash escapes are
+// processed except in `raw strings`, which can also span lines.
+func (l *Lexer) scanString(pos Pos) (Token, string, Pos) {
+	quote := l.read()
+	var b strings.Builder
+	for {
+		ch := l.read()
+		switch {
+		case ch == quote:
+			return STRING, b.String(), pos
+		case ch == eof, ch == '\n' && quote != '`':
+			l.errorf(pos, "Unterminated string")
+			return ILLEGAL, l.src[pos.Offset:l.pos.Offset], pos
+		case ch == '\\' && quote != '`':
+			switch next := l.peek(); next {
+			case 'n':
+				b.WriteRune('\n')
+			case 't':
+				b.WriteRune('\t')
+			case 'r':
+				b.WriteRune('\r')
+			case '\\', '"', '\'', '`':
+				b.WriteRune(next)
+			default:
+				// Keep unknown escapes, e.g. \d in a pattern.
+				b.WriteRune(ch)
+				continue
+			}
+			l.read()
+		default:
+			b.WriteRune(ch)
+		}
+	}
+}
+
+// scanBracket reads an array, such as ["a", "b"] or [1, 2], or a variable
+// reference, such as [a] or [a][b]. A single unquoted name is a variable
+// reference even if it is a number, [1] is the variable named 1 and [+1]
+// the array of 1.
+func (l *Lexer) scanBracket(pos Pos) (Token, string, Pos) {
+	l.read()
+	save := l.pos
+	l.skipWhitespace()
+	ch := l.peek()
+	l.pos = save
+
+	switch {
+	case ch == ']', ch == '"', ch == '\'', ch == '`', ch == '-', ch == '+':
+		return l.scanArray(pos)
+	case ch == '.', isDigit(ch):
+		// Numbers separated by commas are an array.
+		rest := l.src[l.pos.Offset:]
+		if i := strings.IndexAny(rest, "],\n"); i >= 0 && rest[i] == ',' {
+			return l.scanArray(pos)
+		}
+	}
+	return l.scanVarRef(pos)
+}
+
+// scanArray reads an array whose opening bracket has been read, up to
+// the closing bracket outside of the quoted elements.
+func (l *Lexer) scanArray(pos Pos) (Token, string, Pos) {
+	var quote rune
+	for {
+		ch := l.read()
+		switch {
+		case ch == eof:
+			l.errorf(pos, "Unterminated array")
+			return ILLEGAL, l.src[pos.Offset:l.pos.Offset], pos
+		case quote != 0:
+			if ch == '\\' && quote != '`' {
+				l.read()
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '"', ch == '\'', ch == '`':
+			quote = ch
+		case ch == ']':
+			return ARRAY, l.src[pos.Offset+1 : l.pos.Offset-1], pos
+		}
+	}
+}
+
+// scanVarRef reads the segments of a variable reference whose opening
+// bracket has been read. Segments are adjacent, [a][b] is "a.b".
+func (l *Lexer) scanVarRef(pos Pos) (Token, string, Pos) {
+	var segments []string
+	for {
+		start := l.pos.Offset
+		for ch := l.peek(); ch != ']' && ch != '[' && ch != '\n' && ch != eof; ch = l.peek() {
+			l.read()
+		}
+		name := strings.TrimSpace(l.src[start:l.pos.Offset])
+		if !l.accept(']') {
+			l.errorf(pos, "Unterminated variable reference")
+			return ILLEGAL, l.src[pos.Offset:l.pos.Offset], pos
+		}
+		if name == "" {
+			l.errorf(pos, "Empty variable name")
+			return ILLEGAL, l.src[pos.Offset:l.pos.Offset], pos
+		}
+		segments = append(segments, name)
+		if !l.accept('[') {
+			return IDENT, strings.Join(segments, "."), pos
+		}
+	}
+}
+
+// scanDollar reads a $-prefixed variable name such as $0.
+func (l *Lexer) scanDollar(pos Pos) (Token, string, Pos) {
+	l.read()
+	if name := l.scanIdent(); name != "" {
+		return IDENT, "$" + name, pos
+	}
+	return ILLEGAL, "$", pos
+}
+
+// skipWhitespace skips the whitespace characters.
+func (l *Lexer) skipWhitespace() {
+	for unicode.IsSpace(l.peek()) {
+		l.read()
+	}
+}
+
+// read returns the next character and advances the position.
+func (l *Lexer) read() rune {
+	if l.pos.Offset >= len(l.src) {
+		return eof
+	}
+	ch, size := utf8.DecodeRuneInString(l.src[l.pos.Offset:])
+	l.pos.Offset += size
+	if ch == '\n' {
+		l.pos.Line++
+		l.pos.Column = 1
+	} else {
+		l.pos.Column++
+	}
+	return ch
+}
+
+// peek returns the next character without advancing.
+func (l *Lexer) peek() rune { return l.peekAt(0) }
+
+// peekAt returns the character n characters ahead without advancing.
+func (l *Lexer) peekAt(n int) rune {
+	offset := l.pos.Offset
+	for ; n > 0 && offset < len(l.src); n-- {
+		_, size := utf8.DecodeRuneInString(l.src[offset:])
+		offset += size
+	}
+	if offset >= len(l.src) {
+		return eof
+	}
+	ch, _ := utf8.DecodeRuneInString(l.src[offset:])
+	return ch
+}
+
+// accept reads the next character if it is ch.
+func (l *Lexer) accept(ch rune) bool {
+	if l.peek() != ch {
+		return false
+	}
+	l.read()
+	return true
+}
+
+func (l *Lexer) errorf(pos Pos, format string, args ...interface{}) {
+	if l.Error != nil {
+		l.Error(pos, fmt.Sprintf(format, args...))
+	}
+}
+
+func isLetter(ch rune) bool { return ch == '_' || unicode.IsLetter(ch) }
+
+func isDigit(ch rune) bool { return '0' <= ch && ch <= '9' }
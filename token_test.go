@@ -0,0 +1,95 @@
+package conditions
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLexer(t *testing.T) {
+	type token struct {
+		tok Token
+		lit string
+	}
+	data := []struct {
+		src    string
+		tokens []token
+	}{
+		{`[a][b] == 'x'`, []token{{IDENT, "a.b"}, {EQ, "=="}, {STRING, "x"}}},
+		{`[@foo][0]`, []token{{IDENT, "@foo.0"}}},
+		{`[a] [b]`, []token{{IDENT, "a"}, {IDENT, "b"}}},
+		{`$0 AND foo`, []token{{IDENT, "$0"}, {AND, "AND"}, {IDENT, "foo"}}},
+		{`["a", 'b]', ` + "`c`" + `]`, []token{{ARRAY, `"a", 'b]', ` + "`c`"}}},
+		{`[ 1, -2.5 ]`, []token{{ARRAY, ` 1, -2.5 `}}},
+		{`[1] [1abc] [.5] [+1] [-1]`, []token{{IDENT, "1"}, {IDENT, "1abc"}, {IDENT, ".5"}, {ARRAY, "+1"}, {ARRAY, "-1"}}},
+		{`[]`, []token{{ARRAY, ""}}},
+		{`1 1.5 .5 1e3 2.5E-2 1e`, []token{{NUMBER, "1"}, {NUMBER, "1.5"}, {NUMBER, ".5"}, {NUMBER, "1e3"}, {NUMBER, "2.5E-2"}, {NUMBER, "1"}, {IDENT, "e"}}},
+		{`1h30m 5 m 5x`, []token{{DURATION, "1h30m"}, {NUMBER, "5"}, {IDENT, "m"}, {NUMBER, "5"}, {IDENT, "x"}}},
+		{`"a\"b\n" 'it\'s' "\d"`, []token{{STRING, "a\"b\n"}, {STRING, "it's"}, {STRING, `\d`}}},
+		{"`raw\\n\nline`", []token{{STRING, "raw\\n\nline"}}},
+		{`not in NOT x nOt  IN`, []token{{NOTIN, "NOT IN"}, {NOT, "NOT"}, {IDENT, "x"}, {NOTIN, "NOT IN"}}},
+		{`exists x is null IS  NOT Null is x`, []token{{EXISTS, "exists"}, {IDENT, "x"}, {ISNULL, "IS NULL"}, {ISNOTNULL, "IS NOT NULL"}, {IDENT, "is"}, {IDENT, "x"}}},
+		{`!x != !~ =~ = >= <= > <`, []token{{NOT, "!"}, {IDENT, "x"}, {NEQ, "!="}, {NEREG, "!~"}, {EREG, "=~"}, {ILLEGAL, "="}, {GTE, ">="}, {LTE, "<="}, {GT, ">"}, {LT, "<"}}},
+		{`lower ([a], 1) + - * / %`, []token{{FUNC, "lower"}, {LPAREN, "("}, {IDENT, "a"}, {COMMA, ","}, {NUMBER, "1"}, {RPAREN, ")"}, {ADD, "+"}, {SUB, "-"}, {MUL, "*"}, {DIV, "/"}, {MOD, "%"}}},
+		{`TIME "2017-09-13" true False`, []token{{TIME, "TIME"}, {STRING, "2017-09-13"}, {TRUE, "true"}, {FALSE, "False"}}},
+		{`# $`, []token{{ILLEGAL, "#"}, {ILLEGAL, "$"}}},
+		{`[a`, []token{{ILLEGAL, "[a"}}},
+		{`[a][`, []token{{ILLEGAL, "[a]["}}},
+		{`[]]`, []token{{ARRAY, ""}, {ILLEGAL, "]"}}},
+		{`[1, "2`, []token{{ILLEGAL, `[1, "2`}}},
+		{`"abc`, []token{{ILLEGAL, `"abc`}}},
+		{"'abc\n'", []token{{ILLEGAL, "'abc\n"}, {ILLEGAL, "'"}}},
+	}
+
+	for _, td := range data {
+		l := NewLexer(td.src)
+		tokens := []token{}
+		for {
+			tok, lit, _ := l.Scan()
+			if tok == EOF {
+				break
+			}
+			tokens = append(tokens, token{tok, lit})
+		}
+		assert.Equal(t, td.tokens, tokens, td.src)
+	}
+}
+
+func TestLexerPositions(t *testing.T) {
+	l := NewLexer("[a] ==\n\t'é' AND")
+	var errs []string
+	l.Error = func(pos Pos, msg string) { errs = append(errs, msg) }
+
+	for _, want := range []Pos{
+		{Offset: 0, Line: 1, Column: 1},
+		{Offset: 4, Line: 1, Column: 5},
+		{Offset: 8, Line: 2, Column: 2},
+		{Offset: 13, Line: 2, Column: 6},
+		{Offset: 16, Line: 2, Column: 9},
+	} {
+		_, _, pos := l.Scan()
+		assert.Equal(t, want, pos)
+	}
+	assert.Empty(t, errs)
+
+	l = NewLexer(`[a] == "x`)
+	l.Error = func(pos Pos, msg string) { errs = append(errs, msg) }
+	l.Scan()
+	l.Scan()
+	tok, _, pos := l.Scan()
+	assert.Equal(t, ILLEGAL, tok)
+	assert.Equal(t, Pos{Offset: 7, Line: 1, Column: 8}, pos)
+	assert.Equal(t, []string{"Unterminated string"}, errs)
+}
+
+func TestLexerRegex(t *testing.T) {
+	l := NewLexer(`/a\/b c/im AND`)
+	tok, _, _ := l.Scan()
+	assert.Equal(t, DIV, tok)
+	pattern, flags, err := l.ScanRegex()
+	assert.Nil(t, err)
+	assert.Equal(t, "a/b c", pattern)
+	assert.Equal(t, "im", flags)
+	tok, _, _ = l.Scan()
+	assert.Equal(t, AND, tok)
+}
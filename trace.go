@@ -0,0 +1,173 @@
+package conditions
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Trace records the evaluation of an expression node, its children mirror
+// the operands of the node. Parentheses are not recorded.
+type Trace struct {
+	Expr Expr
+	// Op is the operator applied by unary and binary expressions, ILLEGAL
+	// for the other nodes
+	Op Token
+	// Value is the literal the node evaluated to, nil when it failed or
+	// was not evaluated
+	Value Expr
+	Err   error
+	// Evaluated is false for the operands skipped by short-circuiting or
+	// after an error
+	Evaluated bool
+	Children  []*Trace
+}
+
+// EvaluateWithTrace evaluates expr like Evaluate and records the value of
+// every node of the expression in the returned trace.
+func EvaluateWithTrace(expr Expr, args map[string]interface{}) (bool, *Trace, error) {
+	if expr == nil {
+		return false, nil, fmt.Errorf("Provided expression is nil")
+	}
+	if hasBadExpr(expr) {
+		return false, nil, errSyntax
+	}
+	t := traceSubtree(expr, &mapResolver{args: args})
+	if t.Err != nil {
+		return false, t, t.Err
+	}
+	r, err := rootResult(t.Value)
+	return r, t, err
+}
+
+// traceSubtree evaluates expr as evaluateSubtree does, recording the trace
+func traceSubtree(expr Expr, args resolver) *Trace {
+	if p, ok := expr.(*ParenExpr); ok {
+		return traceSubtree(p.Expr, args)
+	}
+
+	t := &Trace{Expr: expr, Evaluated: true}
+	switch n := expr.(type) {
+	case *UnaryExpr:
+		t.Op = n.Op
+		if isPresence(n.Op) {
+			// The variable is tested, not evaluated.
+			t.Value, t.Err = evaluatePresence(n, args)
+			break
+		}
+		x := t.child(traceSubtree(n.Expr, args))
+		if t.Err == nil {
+			t.Value, t.Err = applyUnaryOperator(n.Op, x.Value)
+		}
+	case *BinaryExpr:
+		t.Op = n.Op
+		l := t.child(traceSubtree(n.LHS, args))
+		if t.Err != nil {
+			t.child(skippedTrace(n.RHS))
+			break
+		}
+		if result, ok := shortCircuit(n.Op, l.Value); ok {
+			t.Value = result
+			t.child(skippedTrace(n.RHS))
+			break
+		}
+		r := t.child(traceSubtree(n.RHS, args))
+		if t.Err == nil {
+			t.Value, t.Err = applyOperator(n.Op, l.Value, r.Value)
+		}
+	case *CallExpr:
+		if n.Func == nil {
+			t.Err = fmt.Errorf("Unknown function %s", n.Name)
+		}
+		values := make([]Expr, len(n.Arguments))
+		for i, arg := range n.Arguments {
+			if t.Err != nil {
+				t.child(skippedTrace(arg))
+				continue
+			}
+			values[i] = t.child(traceSubtree(arg, args)).Value
+		}
+		if t.Err == nil {
+			t.Value, t.Err = applyCall(n, values)
+		}
+	default:
+		t.Value, t.Err = evaluateSubtree(expr, args)
+	}
+	if t.Err != nil {
+		t.Value = nil
+	}
+	return t
+}
+
+// child appends the trace of an operand, taking over its error.
+func (t *Trace) child(c *Trace) *Trace {
+	t.Children = append(t.Children, c)
+	if c.Err != nil {
+		t.Err = c.Err
+	}
+	return c
+}
+
+// skippedTrace returns the trace of an expression which is not evaluated
+func skippedTrace(expr Expr) *Trace {
+	if p, ok := expr.(*ParenExpr); ok {
+		return skippedTrace(p.Expr)
+	}
+	t := &Trace{Expr: expr}
+	switch n := expr.(type) {
+	case *UnaryExpr:
+		t.Op = n.Op
+		t.Children = []*Trace{skippedTrace(n.Expr)}
+	case *BinaryExpr:
+		t.Op = n.Op
+		t.Children = []*Trace{skippedTrace(n.LHS), skippedTrace(n.RHS)}
+	case *CallExpr:
+		for _, arg := range n.Arguments {
+			t.Children = append(t.Children, skippedTrace(arg))
+		}
+	}
+	return t
+}
+
+// String renders the trace as an indented tree, a line per node with its
+// value, e.g. `([cpu] > 0.9 => false)`. Literal operands are left out. An
+// error is detailed on the node it originates from.
+func (t *Trace) String() string {
+	var b strings.Builder
+	t.render(&b, 0)
+	return b.String()
+}
+
+func (t *Trace) render(b *strings.Builder, depth int) {
+	b.WriteString(strings.Repeat("  ", depth) + "(" + Format(t.Expr) + " => ")
+	switch {
+	case !t.Evaluated:
+		b.WriteString("not evaluated")
+	case t.Err != nil && t.failedChild() == nil:
+		b.WriteString("error: " + t.Err.Error())
+	case t.Err != nil:
+		b.WriteString("error")
+	default:
+		b.WriteString(Format(t.Value))
+	}
+	b.WriteString(")\n")
+
+	// A skipped subtree is rendered by its root only.
+	if !t.Evaluated {
+		return
+	}
+	for _, c := range t.Children {
+		if !isConstant(c.Expr) {
+			c.render(b, depth+1)
+		}
+	}
+}
+
+// failedChild returns the child the error of the node comes from.
+func (t *Trace) failedChild() *Trace {
+	for _, c := range t.Children {
+		if c.Err != nil {
+			return c
+		}
+	}
+	return nil
+}
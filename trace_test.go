@@ -0,0 +1,85 @@
+package conditions
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvaluateWithTrace(t *testing.T) {
+	expr, err := NewParser(strings.NewReader(`([cpu] > 0.9 AND [mem] > 1024) OR NOT ([host] in ["a", "b"])`)).Parse()
+	if !assert.Nil(t, err) {
+		return
+	}
+	r, trace, err := EvaluateWithTrace(expr, map[string]interface{}{"cpu": 0.5, "mem": 2048, "host": "a"})
+	assert.Nil(t, err)
+	assert.False(t, r)
+
+	assert.Equal(t, OR, trace.Op)
+	assert.Equal(t, &BooleanLiteral{Val: false}, trace.Value)
+	if assert.Len(t, trace.Children, 2) {
+		and := trace.Children[0]
+		assert.Equal(t, AND, and.Op)
+		assert.True(t, and.Evaluated)
+		assert.Equal(t, &NumberLiteral{Val: 0.5}, and.Children[0].Children[0].Value)
+		assert.False(t, and.Children[1].Evaluated)
+		assert.Nil(t, and.Children[1].Value)
+		assert.False(t, and.Children[1].Children[0].Evaluated)
+	}
+	assert.Equal(t, `([cpu] > 0.9 AND [mem] > 1024 OR NOT ([host] IN ["a", "b"]) => false)
+  ([cpu] > 0.9 AND [mem] > 1024 => false)
+    ([cpu] > 0.9 => false)
+      ([cpu] => 0.5)
+    ([mem] > 1024 => not evaluated)
+  (NOT ([host] IN ["a", "b"]) => false)
+    ([host] IN ["a", "b"] => true)
+      ([host] => "a")
+`, trace.String())
+}
+
+func TestEvaluateWithTraceErrors(t *testing.T) {
+	funcs := NewFunctionRegistry()
+	assert.Nil(t, funcs.Register("lower", strings.ToLower))
+	p := NewParser(strings.NewReader(`[a] > 1 AND lower([b]) == "x" OR [c]`))
+	p.SetFunctions(funcs)
+	expr, err := p.Parse()
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	_, trace, err := EvaluateWithTrace(expr, map[string]interface{}{"a": 2, "c": true})
+	assert.NotNil(t, err)
+	assert.Equal(t, err, trace.Err)
+	assert.Equal(t, `([a] > 1 AND lower([b]) == "x" OR [c] => error)
+  ([a] > 1 AND lower([b]) == "x" => error)
+    ([a] > 1 => true)
+      ([a] => 2)
+    (lower([b]) == "x" => error)
+      (lower([b]) => error)
+        ([b] => error: argument: b not found)
+  ([c] => not evaluated)
+`, trace.String())
+
+	_, trace, err = EvaluateWithTrace(expr, map[string]interface{}{"a": 2, "b": 1, "c": true})
+	assert.NotNil(t, err)
+	assert.Contains(t, trace.String(), "(lower([b]) => error: ")
+
+	_, trace, err = EvaluateWithTrace(nil, nil)
+	assert.NotNil(t, err)
+	assert.Nil(t, trace)
+}
+
+func TestEvaluateWithTraceMatchesEvaluate(t *testing.T) {
+	for _, td := range validTestData {
+		expr, err := NewParser(strings.NewReader(td.cond)).Parse()
+		if !assert.Nil(t, err, td.cond) {
+			continue
+		}
+		want, wantErr := Evaluate(expr, td.args)
+		got, trace, gotErr := EvaluateWithTrace(expr, td.args)
+		assert.Equal(t, want, got, td.cond)
+		assert.Equal(t, wantErr, gotErr, td.cond)
+		assert.NotNil(t, trace, td.cond)
+	}
+}